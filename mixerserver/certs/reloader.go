@@ -0,0 +1,146 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package certs loads TLS certificates from disk and keeps them up to
+// date when the files change, so renewed certificates get picked up
+// without restarting the server.
+package certs
+
+import (
+	"crypto/tls"
+	"github.com/fsnotify/fsnotify"
+	"log/slog"
+	"path/filepath"
+	"sync"
+)
+
+// Reloader serves a certificate and key pair loaded from disk,
+// reloading them whenever either file changes.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+	watcher  *fsnotify.Watcher
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// NewReloader loads the given certificate and key, and starts
+// watching them for changes.  Close should be called to stop watching
+// once the Reloader is no longer needed.
+func NewReloader(
+	certFile string,
+	keyFile string,
+	logger *slog.Logger,
+) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	r.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates tend to get replaced by renaming a new file over
+	// the old one, which a watch on the file itself won't survive, so
+	// watch the directories they live in instead.
+	dirs := map[string]bool{
+		filepath.Dir(certFile): true,
+		filepath.Dir(keyFile):  true,
+	}
+	for dir := range dirs {
+		err = r.watcher.Add(dir)
+		if err != nil {
+			r.watcher.Close()
+			return nil, err
+		}
+	}
+
+	go r.watch()
+	return r, nil
+}
+
+// GetCertificate returns the most recently loaded certificate.  It
+// has the signature tls.Config expects for its GetCertificate field.
+func (r *Reloader) GetCertificate(
+	*tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// Close stops watching the certificate files.
+func (r *Reloader) Close() error {
+	return r.watcher.Close()
+}
+
+// load reads the certificate and key from disk and swaps them in.
+func (r *Reloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.certificate = &certificate
+	r.mutex.Unlock()
+	return nil
+}
+
+// reloadOps are the kinds of file events that trigger a reload.
+const reloadOps = fsnotify.Write | fsnotify.Create
+
+// watch reloads the certificate whenever anything in its directories
+// is written or created.  That's broader than strictly necessary, but
+// it also catches setups like Kubernetes secrets, where the files are
+// symlinks that get switched over by replacing a different entry in
+// the directory.  If the new files can't be loaded (say because only
+// one of the two has been replaced so far), the old certificate stays
+// in use until the next change.
+func (r *Reloader) watch() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&reloadOps == 0 {
+				continue
+			}
+
+			err := r.load()
+			if err != nil {
+				r.logger.Warn("couldn't reload certificate", "error", err)
+			} else {
+				r.logger.Info("reloaded certificate", "file", r.certFile)
+			}
+
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Warn("error watching certificate files", "error", err)
+		}
+	}
+}
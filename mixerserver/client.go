@@ -0,0 +1,169 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/config"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/credentials"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/spf13/viper"
+	"os"
+)
+
+// loadClientConfig loads and checks the config for the command line
+// client commands, and sets up a logger for them on ctx.
+func loadClientConfig(ctx gocontext.Context) (gocontext.Context, error) {
+	err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %w", err)
+	}
+	if problems := config.ValidateClient(); len(problems) != 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", problem)
+		}
+		return nil, fmt.Errorf("found %d config problem(s)", len(problems))
+	}
+
+	logger, err := newLogger(
+		os.Stderr,
+		"logfmt",
+		viper.GetString("log_level"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithLogger(ctx, logger), nil
+}
+
+// credentialsPath returns the configured credentials file, or the
+// default one if none is set.
+func credentialsPath() (string, error) {
+	if path := viper.GetString("credentials_file"); path != "" {
+		return path, nil
+	}
+	return credentials.DefaultPath()
+}
+
+// clientAuthTokens trades a refresh token for fresh auth tokens.  The
+// refresh token comes from spotify_refresh_token if it's set, or else
+// from the credentials saved by the login command.  Either way, any
+// new refresh token Spotify hands back is saved to the credentials
+// file for next time.
+func clientAuthTokens(ctx gocontext.Context) (spotify.AuthTokens, error) {
+	clientID := viper.GetString("spotify_client_id")
+	clientSecret := viper.GetString("spotify_client_secret")
+
+	refreshToken := viper.GetString("spotify_refresh_token")
+	if refreshToken != "" {
+		authTokens, err := spotify.RefreshAuthTokens(
+			ctx,
+			spotify.AuthTokens{RefreshToken: refreshToken},
+			clientID,
+			clientSecret,
+		)
+		if err != nil {
+			return authTokens, fmt.Errorf(
+				"couldn't refresh auth tokens: %w",
+				err,
+			)
+		}
+
+		// Spotify rotates refresh tokens for public clients, and the
+		// old one stops working.  The new one is a live credential,
+		// so rather than print it where it could end up in logs, save
+		// it the way the login command would.
+		if authTokens.RefreshToken != refreshToken {
+			err = saveRotatedTokens(ctx, authTokens, clientID)
+			if err != nil {
+				return authTokens, err
+			}
+		}
+		return authTokens, nil
+	}
+
+	path, err := credentialsPath()
+	if err != nil {
+		return spotify.AuthTokens{}, err
+	}
+	saved, err := credentials.Load(path)
+	if err != nil {
+		return spotify.AuthTokens{}, err
+	}
+	if saved.ClientID != clientID {
+		return spotify.AuthTokens{}, errors.New(
+			"saved credentials are for a different spotify_client_id, " +
+				"run the login command again",
+		)
+	}
+
+	authTokens, err := spotify.RefreshAuthTokens(
+		ctx,
+		saved.AuthTokens,
+		clientID,
+		clientSecret,
+	)
+	if err != nil {
+		return authTokens, fmt.Errorf("couldn't refresh auth tokens: %w", err)
+	}
+
+	saved.AuthTokens = authTokens
+	err = credentials.Save(path, saved)
+	if err != nil {
+		return authTokens, fmt.Errorf("couldn't save credentials: %w", err)
+	}
+	return authTokens, nil
+}
+
+// saveRotatedTokens saves the auth tokens Spotify handed back in place
+// of spotify_refresh_token to the credentials file, and tells the user
+// how to start using them.
+func saveRotatedTokens(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	clientID string,
+) error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	userID, err := spotify.GetUserID(ctx, authTokens)
+	if err != nil {
+		return err
+	}
+	err = credentials.Save(path, credentials.Credentials{
+		AuthTokens: authTokens,
+		ClientID:   clientID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save credentials: %w", err)
+	}
+
+	context.Logger(ctx).Warn(
+		"spotify_refresh_token was rotated, remove it from the config "+
+			"to use the saved credentials",
+		"path", path,
+	)
+	return nil
+}
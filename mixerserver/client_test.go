@@ -0,0 +1,98 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/credentials"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientAuthTokensSavesRotatedToken(t *testing.T) {
+	const rotated = "rotated-refresh-token"
+	t.Cleanup(spotify.StubAPI(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/token":
+				fmt.Fprintf(
+					w,
+					`{"access_token":"access","refresh_token":%q,`+
+						`"expires_in":3600}`,
+					rotated,
+				)
+			case "/v1/me":
+				fmt.Fprint(w, `{"id":"me"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	)))
+
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	defer viper.Reset()
+	viper.Set("spotify_client_id", "client")
+	viper.Set("spotify_refresh_token", "original-refresh-token")
+	viper.Set("credentials_file", path)
+
+	logs := &bytes.Buffer{}
+	ctx := context.WithLogger(
+		gocontext.Background(),
+		slog.New(slog.NewTextHandler(logs, nil)),
+	)
+	authTokens, err := clientAuthTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authTokens.RefreshToken != rotated {
+		t.Errorf(
+			"got refresh token %q, want %q",
+			authTokens.RefreshToken,
+			rotated,
+		)
+	}
+
+	if strings.Contains(logs.String(), rotated) {
+		t.Errorf("rotated refresh token logged: %s", logs)
+	}
+	saved, err := credentials.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RefreshToken != rotated || saved.ClientID != "client" {
+		t.Errorf("saved %+v, want the rotated token", saved)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credentials saved with mode %v, want 0600", info.Mode())
+	}
+}
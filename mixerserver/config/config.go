@@ -0,0 +1,294 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package config loads the server's settings through viper, from
+// defaults, environment variables and an optional config file, and
+// checks them before anything tries to use them.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// setting describes a single config key: its default value (nil if
+// it has none) and the help text for the matching command line flag.
+type setting struct {
+	key          string
+	defaultValue interface{}
+	usage        string
+}
+
+// serverSettings lists every config key the server uses.  Each can be
+// set from the config file, the environment (as the upper-cased key)
+// or the command line (as the key with dashes instead of
+// underscores).  spotify_scopes is the exception, since it's a map and
+// can only come from the config file.
+var serverSettings = []setting{
+	{"port", 80, "port to serve plain HTTP on"},
+	{"static_path", "", "directory holding the templates and static files"},
+	{"spotify_client_id", "", "Spotify API client ID"},
+	{
+		"spotify_client_secret",
+		"",
+		"Spotify API client secret (optional with PKCE)",
+	},
+	{"token_key", "", "base64 AES key used to encrypt session tokens"},
+	{
+		"spotify_login_features",
+		[]string{
+			string(spotify.FeaturePlaylists),
+			string(spotify.FeatureMix),
+		},
+		"features to request consent for when logging in",
+	},
+	{"session_lifetime", 720 * time.Hour, "how long a session stays valid"},
+	{"log_format", "json", "log format: json, logfmt or text"},
+	{"log_level", "info", "minimum level to log at"},
+	{"tracing_exporter", "none", "trace exporter, otlp, stdout or none"},
+	{
+		"drain_timeout",
+		30 * time.Second,
+		"how long to wait for running jobs on shutdown",
+	},
+	{"tls_port", 443, "port to serve HTTPS on when TLS is enabled"},
+	{"tls_cert_file", "", "TLS certificate file, reloaded when it changes"},
+	{"tls_key_file", "", "TLS private key file"},
+	{
+		"tls_autocert_hosts",
+		[]string{},
+		"hosts to fetch certificates for over ACME",
+	},
+	{
+		"tls_autocert_cache_dir",
+		"autocert-cache",
+		"directory to cache ACME certificates in",
+	},
+	{"tls_autocert_email", "", "contact email for the ACME account"},
+	{
+		"metrics_addr",
+		"localhost:9090",
+		"address to serve Prometheus metrics on, or empty to disable them",
+	},
+	{"store_path", "mixer.db", "database file for schedules and history"},
+	{"webhook_urls", []string{}, "webhooks to notify about every mix"},
+	{"webhook_secret", "", "secret to sign requests to webhook_urls with"},
+	{
+		"webhook_events",
+		webhook.Events,
+		"events to notify webhook_urls of",
+	},
+	{
+		"webhook_allow_private",
+		false,
+		"let users' webhooks reach private network addresses",
+	},
+	{
+		"watch_interval",
+		5 * time.Minute,
+		"how often to check watched schedules' sources for changes",
+	},
+	{
+		"watch_debounce",
+		2 * time.Minute,
+		"how long sources must go unchanged before a watched mix runs",
+	},
+	{
+		"public_url",
+		"",
+		"externally visible base URL, including any path prefix",
+	},
+	{
+		"allowed_hosts",
+		[]string{},
+		"Host headers to accept (defaults to the public_url host)",
+	},
+}
+
+// clientSettings lists the config keys the command line client uses
+// to talk to Spotify directly.
+var clientSettings = []setting{
+	{"spotify_client_id", "", "Spotify API client ID"},
+	{
+		"spotify_client_secret",
+		"",
+		"Spotify API client secret (optional with PKCE)",
+	},
+	{
+		"spotify_refresh_token",
+		"",
+		"Spotify refresh token to use instead of saved credentials",
+	},
+	{
+		"credentials_file",
+		"",
+		"where the login command saves tokens " +
+			"(default mixer/credentials.json in the user config dir)",
+	},
+	{"log_level", "info", "minimum level to log at"},
+}
+
+// flagName returns the command line flag name for a config key.
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// AddFlags registers a command line flag for every server config key
+// on the given flag set, along with --config to name a specific config
+// file.  BindFlags must be called before Load for the flags to take
+// effect.
+func AddFlags(flags *pflag.FlagSet) {
+	addFlags(flags, serverSettings)
+}
+
+// AddClientFlags is AddFlags for the command line client's config
+// keys.
+func AddClientFlags(flags *pflag.FlagSet) {
+	addFlags(flags, clientSettings)
+}
+
+func addFlags(flags *pflag.FlagSet, settings []setting) {
+	flags.String(
+		"config",
+		"",
+		"config file to read instead of searching for one",
+	)
+	for _, s := range settings {
+		name := flagName(s.key)
+		switch value := s.defaultValue.(type) {
+		case bool:
+			flags.Bool(name, value, s.usage)
+		case int:
+			flags.Int(name, value, s.usage)
+		case time.Duration:
+			flags.Duration(name, value, s.usage)
+		case []string:
+			flags.StringSlice(name, value, s.usage)
+		default:
+			flags.String(name, fmt.Sprint(value), s.usage)
+		}
+	}
+}
+
+// BindFlags binds flags registered by AddFlags or AddClientFlags into
+// viper, so any that are set on the command line take precedence over
+// the environment and config file.
+func BindFlags(flags *pflag.FlagSet) error {
+	for _, s := range append(serverSettings, clientSettings...) {
+		flag := flags.Lookup(flagName(s.key))
+		if flag == nil {
+			continue
+		}
+		err := viper.BindPFlag(s.key, flag)
+		if err != nil {
+			return err
+		}
+	}
+	return viper.BindPFlag("config", flags.Lookup("config"))
+}
+
+// Load sets up the default values and environment bindings for every
+// config key, then reads the config file.  That's the one named by
+// the config key if it's set, or else the first config.* found in the
+// working directory, ./config or /run/secrets.  A missing config file
+// is only an error if it was named explicitly, since everything can be
+// set through the environment instead, but a file that's present and
+// can't be parsed always is.
+func Load() error {
+	for _, s := range append(serverSettings, clientSettings...) {
+		if s.defaultValue != nil {
+			viper.SetDefault(s.key, s.defaultValue)
+		}
+		viper.BindEnv(s.key)
+	}
+
+	if file := viper.GetString("config"); file != "" {
+		viper.SetConfigFile(file)
+		return viper.ReadInConfig()
+	}
+
+	viper.SetConfigName("config")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath("./config")
+	viper.AddConfigPath("/run/secrets")
+
+	err := viper.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// FileUsed returns the path of the config file Load read, or an empty
+// string if none was found.
+func FileUsed() string {
+	return viper.ConfigFileUsed()
+}
+
+// PublicURL parses the public_url key, returning nil if it isn't set.
+// Any trailing slash is dropped from the path so it can be used
+// directly as a route prefix.
+func PublicURL() (*url.URL, error) {
+	raw := viper.GetString("public_url")
+	if raw == "" {
+		return nil, nil
+	}
+
+	publicURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if publicURL.Scheme != "http" && publicURL.Scheme != "https" {
+		return nil, fmt.Errorf(
+			"must use http or https, not %q",
+			publicURL.Scheme,
+		)
+	}
+	if publicURL.Host == "" {
+		return nil, errors.New("must include a host")
+	}
+	if publicURL.RawQuery != "" || publicURL.Fragment != "" {
+		return nil, errors.New("can't have a query or fragment")
+	}
+
+	publicURL.Path = strings.TrimRight(publicURL.Path, "/")
+	publicURL.RawPath = ""
+	return publicURL, nil
+}
+
+// FeatureScopes returns the default scopes for each feature, with any
+// feature listed under spotify_scopes replacing the default set of
+// scopes for that feature.
+func FeatureScopes() spotify.FeatureScopes {
+	featureScopes := spotify.DefaultFeatureScopes()
+	for feature, scopes := range viper.GetStringMapStringSlice(
+		"spotify_scopes",
+	) {
+		featureScopes[spotify.Feature(feature)] = scopes
+	}
+	return featureScopes
+}
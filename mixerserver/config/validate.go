@@ -0,0 +1,326 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Problem describes a single config key with an unusable value.
+type Problem struct {
+	Key     string
+	Message string
+}
+
+func (p Problem) Error() string {
+	return p.Key + ": " + p.Message
+}
+
+// templateNames are the templates static_path has to contain.
+var templateNames = []string{"index.got", "login.got", "error.got"}
+
+// problemList collects problems as validation goes along.
+type problemList []Problem
+
+func (problems *problemList) add(
+	key string,
+	format string,
+	args ...interface{},
+) {
+	*problems = append(
+		*problems,
+		Problem{Key: key, Message: fmt.Sprintf(format, args...)},
+	)
+}
+
+// Validate checks every server config key, and returns all of the
+// problems it finds rather than stopping at the first one.  An empty
+// result means the server is safe to start.
+func Validate() []Problem {
+	problems := problemList{}
+	add := problems.add
+
+	// The client secret is optional: without one we log in as a
+	// public client, relying on PKCE.
+	if viper.GetString("spotify_client_id") == "" {
+		add("spotify_client_id", "must be set")
+	}
+
+	if key := viper.GetString("token_key"); key == "" {
+		add("token_key", "must be set (generate one with the keygen command)")
+	} else if _, err := crypto.DecodeAESKey(key); err != nil {
+		add("token_key", "%s", err)
+	}
+
+	if staticPath := viper.GetString("static_path"); staticPath == "" {
+		add("static_path", "must be set")
+	} else {
+		for _, name := range templateNames {
+			templatePath := filepath.Join(staticPath, "template", name)
+			if _, err := os.Stat(templatePath); err != nil {
+				add("static_path", "missing template %s", templatePath)
+			}
+		}
+	}
+
+	validatePort := func(key string) {
+		port, err := cast.ToIntE(viper.Get(key))
+		if err != nil {
+			add(key, "%s", err)
+		} else if port < 1 || port > 65535 {
+			add(key, "%d is out of range (1-65535)", port)
+		}
+	}
+	validatePort("port")
+
+	if addr := viper.GetString("metrics_addr"); addr != "" {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			add("metrics_addr", "%s", err)
+		} else if n, err := strconv.Atoi(port); err != nil ||
+			n < 1 || n > 65535 {
+			add("metrics_addr", "invalid port %q", port)
+		}
+	}
+
+	validateDuration := func(key string) {
+		duration, err := cast.ToDurationE(viper.Get(key))
+		if err != nil {
+			add(key, "%s", err)
+		} else if duration <= 0 {
+			add(key, "must be positive")
+		}
+	}
+	validateDuration("session_lifetime")
+	validateDuration("drain_timeout")
+	validateDuration("watch_interval")
+	debounce, err := cast.ToDurationE(viper.Get("watch_debounce"))
+	if err != nil {
+		add("watch_debounce", "%s", err)
+	} else if debounce < 0 {
+		add("watch_debounce", "can't be negative")
+	}
+
+	switch strings.ToLower(viper.GetString("log_format")) {
+	case "json", "logfmt", "text":
+	default:
+		add(
+			"log_format",
+			"unknown format %q (use json, logfmt or text)",
+			viper.GetString("log_format"),
+		)
+	}
+
+	validateLogLevel(&problems)
+
+	switch viper.GetString("tracing_exporter") {
+	case "", "none", "otlp", "stdout":
+	default:
+		add(
+			"tracing_exporter",
+			"unknown exporter %q (use otlp, stdout or none)",
+			viper.GetString("tracing_exporter"),
+		)
+	}
+
+	knownScopes := map[string]bool{}
+	for _, scope := range spotify.KnownScopes {
+		knownScopes[scope] = true
+	}
+	for feature, scopes := range viper.GetStringMapStringSlice(
+		"spotify_scopes",
+	) {
+		for _, scope := range scopes {
+			if !knownScopes[scope] {
+				add("spotify_scopes", "%s: unknown scope %q", feature, scope)
+			}
+		}
+	}
+
+	featureScopes := FeatureScopes()
+	for _, feature := range viper.GetStringSlice("spotify_login_features") {
+		if _, ok := featureScopes[spotify.Feature(feature)]; !ok {
+			add("spotify_login_features", "unknown feature %q", feature)
+		}
+	}
+
+	if storePath := viper.GetString("store_path"); storePath == "" {
+		add("store_path", "must be set")
+	} else if _, err := os.Stat(filepath.Dir(storePath)); err != nil {
+		add("store_path", "%s", err)
+	}
+
+	if _, err := PublicURL(); err != nil {
+		add("public_url", "%s", err)
+	}
+	for _, host := range viper.GetStringSlice("allowed_hosts") {
+		if err := validateHost(host); err != nil {
+			add("allowed_hosts", "%q: %s", host, err)
+		}
+	}
+
+	webhookURLs := viper.GetStringSlice("webhook_urls")
+	for _, hookURL := range webhookURLs {
+		if err := webhook.ValidateURL(hookURL); err != nil {
+			add("webhook_urls", "%s: %s", hookURL, err)
+		}
+	}
+	if len(webhookURLs) != 0 && viper.GetString("webhook_secret") == "" {
+		add("webhook_secret", "must be set to use webhook_urls")
+	}
+	err = webhook.ValidateEvents(viper.GetStringSlice("webhook_events"))
+	if err != nil {
+		add("webhook_events", "%s", err)
+	}
+
+	certFile := viper.GetString("tls_cert_file")
+	keyFile := viper.GetString("tls_key_file")
+	autocertHosts := viper.GetStringSlice("tls_autocert_hosts")
+	if certFile != "" && len(autocertHosts) != 0 {
+		add("tls_cert_file", "can't be set along with tls_autocert_hosts")
+	}
+	if (certFile == "") != (keyFile == "") {
+		add("tls_cert_file", "must be set together with tls_key_file")
+	}
+	for _, key := range []string{"tls_cert_file", "tls_key_file"} {
+		if file := viper.GetString(key); file != "" {
+			if _, err := os.Stat(file); err != nil {
+				add(key, "%s", err)
+			}
+		}
+	}
+	if certFile != "" || len(autocertHosts) != 0 {
+		validatePort("tls_port")
+	}
+	for _, host := range autocertHosts {
+		if err := validateHost(host); err != nil {
+			add("tls_autocert_hosts", "%q: %s", host, err)
+		}
+	}
+	if email := viper.GetString("tls_autocert_email"); email != "" {
+		address, err := mail.ParseAddress(email)
+		if err != nil || address.Address != email {
+			add("tls_autocert_email", "%q isn't an email address", email)
+		}
+	}
+	if len(autocertHosts) != 0 {
+		cacheDir := viper.GetString("tls_autocert_cache_dir")
+		if cacheDir == "" {
+			add("tls_autocert_cache_dir", "must be set")
+		} else if err := checkWritable(cacheDir); err != nil {
+			add("tls_autocert_cache_dir", "%s", err)
+		}
+	}
+	if certFile != "" &&
+		viper.GetString("public_url") == "" &&
+		len(viper.GetStringSlice("allowed_hosts")) == 0 {
+		add(
+			"tls_cert_file",
+			"needs public_url or allowed_hosts set, "+
+				"so plain HTTP knows where to redirect",
+		)
+	}
+
+	return problems
+}
+
+// hostnamePattern matches a DNS hostname.
+var hostnamePattern = regexp.MustCompile(
+	`^(?i)[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`,
+)
+
+// validateHost checks that host is a hostname or IP address,
+// optionally followed by a port.
+func validateHost(host string) error {
+	hostname := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
+
+	if net.ParseIP(hostname) == nil && !hostnamePattern.MatchString(hostname) {
+		return errors.New("not a valid hostname or IP address")
+	}
+	return nil
+}
+
+// checkWritable makes sure we can create files in dir, or can create
+// dir itself if it doesn't exist yet.
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		break
+	}
+
+	file, err := os.CreateTemp(dir, ".mixer-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// ValidateClient checks the config keys the command line client uses.
+// The refresh token is left to the caller, since it may come from
+// somewhere other than the config.
+func ValidateClient() []Problem {
+	problems := problemList{}
+	if viper.GetString("spotify_client_id") == "" {
+		problems.add("spotify_client_id", "must be set")
+	}
+	validateLogLevel(&problems)
+	return problems
+}
+
+func validateLogLevel(problems *problemList) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(viper.GetString("log_level")))
+	if err != nil {
+		problems.add("log_level", "%s", err)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package config
+
+import (
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"mixer.example.com", true},
+		{"Mixer.Example.com:8080", true},
+		{"localhost", true},
+		{"192.0.2.1:443", true},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8::1]", true},
+		{"mixer.example.com:0", false},
+		{"mixer.example.com:http", false},
+		{"-mixer.example.com", false},
+		{"mixer..example.com", false},
+		{"mixer.example.com/path", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		err := validateHost(test.host)
+		if (err == nil) != test.valid {
+			t.Errorf(
+				"validateHost(%q) = %v, want valid %v",
+				test.host,
+				err,
+				test.valid,
+			)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(dir); err != nil {
+		t.Errorf("existing directory: %v", err)
+	}
+	if err := checkWritable(filepath.Join(dir, "a", "b")); err != nil {
+		t.Errorf("directory to be created: %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(filepath.Join(file, "cache")); err == nil {
+		t.Error("accepted a directory under a file")
+	}
+}
+
+func TestValidateNewKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value interface{}
+		ok    bool
+	}{
+		{"good host", "allowed_hosts", []string{"mixer.example.com"}, true},
+		{"bad host", "allowed_hosts", []string{"bad host"}, false},
+		{
+			"known scope",
+			"spotify_scopes",
+			map[string][]string{"mix": {"user-top-read"}},
+			true,
+		},
+		{
+			"unknown scope",
+			"spotify_scopes",
+			map[string][]string{"mix": {"user-read-everything"}},
+			false,
+		},
+		{"good email", "tls_autocert_email", "ops@example.com", true},
+		{"bad email", "tls_autocert_email", "ops at example.com", false},
+		{
+			"named email",
+			"tls_autocert_email",
+			"Ops <ops@example.com>",
+			false,
+		},
+		{"json logs", "log_format", "json", true},
+		{"logfmt logs", "log_format", "logfmt", true},
+		{"text logs", "log_format", "text", true},
+		{"unknown log format", "log_format", "xml", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set(test.key, test.value)
+
+			ok := true
+			for _, problem := range Validate() {
+				if problem.Key == test.key {
+					ok = false
+				}
+			}
+			if ok != test.ok {
+				t.Errorf(
+					"%s = %v accepted %v, want %v",
+					test.key,
+					test.value,
+					ok,
+					test.ok,
+				)
+			}
+		})
+	}
+}
+
+func TestValidateAutocertCacheDir(t *testing.T) {
+	defer viper.Reset()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("tls_autocert_hosts", []string{"mixer.example.com"})
+	viper.Set("tls_autocert_cache_dir", filepath.Join(file, "cache"))
+
+	for _, problem := range Validate() {
+		if problem.Key == "tls_autocert_cache_dir" {
+			return
+		}
+	}
+	t.Error("unwritable cache directory accepted")
+}
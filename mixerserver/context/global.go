@@ -1,21 +1,54 @@
 package context
 
 import (
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"github.com/bieber/mixer/mixerserver/session"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/bieber/mixer/mixerserver/webhook"
 	"github.com/gorilla/mux"
 	"html/template"
+	"log/slog"
+	"net/url"
+	"time"
 )
 
 // GlobalContext stores data relevant to the entire server process.
 // Only a single instance need exist, and controllers should not write
 // to it.
 type GlobalContext struct {
-	Router    *mux.Router
-	Templates struct {
+	Logger *slog.Logger
+	Router *mux.Router
+	Jobs   *jobs.Manager
+	Store  *store.Store
+	// Webhooks notifies webhooks when mixes finish.
+	Webhooks *webhook.Dispatcher
+	// PublicURL is the externally visible base URL of the server, if
+	// one is configured.  Its path is the prefix every route is
+	// mounted under.
+	PublicURL *url.URL
+	// AllowedHosts lists the Host headers requests are accepted
+	// with.  If it's empty, any host is accepted.
+	AllowedHosts []string
+	Templates    struct {
 		Index *template.Template
 		Login *template.Template
+		Error *template.Template
 	}
 	Spotify struct {
 		ClientID     string
 		ClientSecret string
+		// Scopes lists the OAuth scopes each feature needs, and
+		// LoginFeatures the features users are asked to consent
+		// to when they first log in.  Anything else is requested
+		// incrementally the first time it's used.
+		Scopes        spotify.FeatureScopes
+		LoginFeatures []spotify.Feature
+	}
+	Sessions struct {
+		Lifetime time.Duration
+		// DenyList is internally synchronized, so it's the one
+		// thing in here that controllers may write to.
+		DenyList *session.DenyList
 	}
 }
@@ -0,0 +1,26 @@
+package context
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Detach creates a context for a background job spawned by a
+// request.  It carries over the request's session so the job can
+// keep calling the API, but none of its cancellation or deadlines,
+// since the job is expected to outlive the request.  The job logs
+// through the request's logger tagged with its own job ID, so its
+// entries can be traced back to the request that started it.  For the
+// same reason, any spans the job starts are parented to the request's
+// span, even though that will usually have ended by then.
+func Detach(parent context.Context, jobID string) context.Context {
+	ctx := trace.ContextWithSpanContext(
+		context.Background(),
+		trace.SpanContextFromContext(parent),
+	)
+	ctx = WithRequestID(ctx, RequestID(parent))
+	ctx = WithSession(ctx, Session(parent))
+	ctx = WithLogger(ctx, Logger(parent).With("job_id", jobID))
+	ctx = WithJobID(ctx, jobID)
+	return ctx
+}
@@ -1,41 +1,79 @@
 package context
 
 import (
-	"github.com/bieber/logger"
+	"context"
+	"github.com/bieber/mixer/mixerserver/session"
 	"github.com/bieber/mixer/mixerserver/spotify"
-	"net/http"
-	"sync"
+	"log/slog"
 )
 
-// LocalContext stores context relevant to a single request.  It
-// should be both written to and read from by middleware, and read
-// from by controllers.
-type LocalContext struct {
-	Logger     *logger.Logger
-	AuthTokens spotify.AuthTokens
-}
+// Request-scoped values are stored on the request's context.Context
+// rather than in a struct of our own.  Middleware should write them
+// with the With* functions and pass the resulting request on, and
+// controllers read them back with the typed accessors below.
+
+type contextKey int
 
-var localMutex = sync.Mutex{}
-var localContexts = make(map[*http.Request]*LocalContext)
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	sessionKey
+	jobIDKey
+)
 
-// Get returns the LocalContext for a given request, or creates one if
-// it doesn't already exist.
-func Get(request *http.Request) *LocalContext {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+// WithLogger returns a copy of ctx carrying the given logger.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
 
-	if c, ok := localContexts[request]; ok {
-		return c
+// Logger returns the logger attached to ctx, or the default logger if
+// there isn't one.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
 	}
-	c := &LocalContext{}
-	localContexts[request] = c
-	return c
+	return slog.Default()
+}
+
+// WithRequestID returns a copy of ctx carrying the given request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the ID of the request ctx belongs to, or an empty
+// string if there isn't one.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithSession returns a copy of ctx carrying the given session token.
+func WithSession(ctx context.Context, token session.Token) context.Context {
+	return context.WithValue(ctx, sessionKey, token)
+}
+
+// Session returns the session token attached to ctx, or an empty
+// token if there isn't one.
+func Session(ctx context.Context) session.Token {
+	token, _ := ctx.Value(sessionKey).(session.Token)
+	return token
+}
+
+// AuthTokens returns the Spotify auth tokens from the session
+// attached to ctx.
+func AuthTokens(ctx context.Context) spotify.AuthTokens {
+	return Session(ctx).AuthTokens
+}
+
+// WithJobID returns a copy of ctx carrying the given background job
+// ID.
+func WithJobID(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(ctx, jobIDKey, jobID)
 }
 
-// Clear removes the LocalContext entry for a request after it's
-// finished.
-func Clear(request *http.Request) {
-	localMutex.Lock()
-	defer localMutex.Unlock()
-	delete(localContexts, request)
+// JobID returns the background job ID attached to ctx, or an empty
+// string if it isn't a job context.
+func JobID(ctx context.Context) string {
+	jobID, _ := ctx.Value(jobIDKey).(string)
+	return jobID
 }
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package credentials stores Spotify tokens on disk for the command
+// line client, so a user only has to log in through the browser once.
+// The file holds a live refresh token, so it's only ever readable by
+// its owner.
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotFound is returned by Load when there's no credentials file.
+var ErrNotFound = errors.New("No saved credentials, run the login command")
+
+// Credentials are the tokens saved by the login command.  ClientID
+// records the Spotify app the tokens were issued to, since they can
+// only be refreshed by that same app.
+type Credentials struct {
+	spotify.AuthTokens
+	ClientID string    `json:"client_id"`
+	UserID   string    `json:"user_id"`
+	Saved    time.Time `json:"saved"`
+}
+
+// DefaultPath returns where credentials are kept if no other path is
+// configured: mixer/credentials.json under the user's config
+// directory.
+func DefaultPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "mixer", "credentials.json"), nil
+}
+
+// Load reads credentials from the given file.  It refuses to read a
+// file anyone but its owner can access, in case it was copied around
+// carelessly.
+func Load(path string) (Credentials, error) {
+	credentials := Credentials{}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return credentials, ErrNotFound
+	} else if err != nil {
+		return credentials, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return credentials, fmt.Errorf(
+			"%s is accessible by other users, chmod it to 0600",
+			path,
+		)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return credentials, err
+	}
+	err = json.Unmarshal(contents, &credentials)
+	return credentials, err
+}
+
+// Save writes credentials to the given file with 0600 permissions,
+// creating its directory if need be.  The file is replaced atomically,
+// so a failed write never loses the previous refresh token.
+func Save(path string, credentials Credentials) error {
+	credentials.Saved = time.Now()
+	contents, err := json.MarshalIndent(credentials, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp always creates files with 0600 permissions.
+	file, err := os.CreateTemp(dir, ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(append(contents, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -45,18 +45,42 @@ func GenerateAESKey() (string, error) {
 	return base64.URLEncoding.EncodeToString(keyBytes), nil
 }
 
+// GenerateNonce generates a random 16 byte value suitable for
+// identifying sessions and the like, and returns it encoded as
+// base64.
+func GenerateNonce() (string, error) {
+	nonceBytes := make([]byte, 16, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(nonceBytes), nil
+}
+
+// DecodeAESKey decodes a base64 AES key, as generated by
+// GenerateAESKey, and checks that it's the right length.
+func DecodeAESKey(key string) ([]byte, error) {
+	keyBytes, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keyBytes) != 16 {
+		return nil, errors.New("Invalid key length")
+	}
+	return keyBytes, nil
+}
+
 // SetAESKey sets the AES key to use for crypto operations.  It should
 // be 16 bytes encoded in base64.
 func SetAESKey(key string) error {
-	var err error
-	aesKey, err = base64.URLEncoding.DecodeString(key)
+	keyBytes, err := DecodeAESKey(key)
 	if err != nil {
 		return err
 	}
 
-	if len(aesKey) != 16 {
-		return errors.New("Invalid key length")
-	}
+	aesKey = keyBytes
 	return nil
 }
 
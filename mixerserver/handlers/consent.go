@@ -0,0 +1,56 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"github.com/bieber/mixer/mixerserver/context"
+	"net/http"
+)
+
+// ConsentRequired tells the client that the user needs to grant
+// additional scopes before the request can go through, and hands it
+// a login URI that asks for them on top of everything the user has
+// already granted.  It responds by panicking with a consent_required
+// error, so it must be run beneath an ErrorCatcher.
+func ConsentRequired(
+	globalContext *context.GlobalContext,
+	missingScopes []string,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopes := append(
+			context.AuthTokens(r.Context()).Scopes(),
+			missingScopes...,
+		)
+		loginURI, err := newLoginURI(globalContext, r, scopes)
+		if err != nil {
+			panic(err)
+		}
+
+		panic(&Error{
+			Status:  http.StatusForbidden,
+			Code:    CodeConsentRequired,
+			Message: "Additional permissions are required",
+			Details: map[string]interface{}{
+				"scopes":    missingScopes,
+				"login_uri": loginURI.String(),
+			},
+		})
+	}
+}
@@ -20,24 +20,304 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/session"
+	"github.com/bieber/mixer/mixerserver/spotify"
 	"net/http"
+	"strconv"
 )
 
+// Error codes sent to clients.  These are part of the API, so they
+// shouldn't change once they've been handed out.
+const (
+	CodeBadRequest      = "bad_request"
+	CodeInvalidRequest  = "invalid_request"
+	CodeUnauthenticated = "unauthenticated"
+	CodeForbidden       = "forbidden"
+	CodeConsentRequired = "consent_required"
+	CodeNotFound        = "not_found"
+	CodeBadMethod       = "method_not_allowed"
+	CodeRateLimited     = "rate_limited"
+	CodeUpstream        = "upstream_error"
+	CodeUnavailable     = "unavailable"
+	CodeInternal        = "internal_error"
+)
+
+// Error is an error that knows how it should be presented to the
+// client.  Controllers and middleware can panic with one to abort the
+// request with a specific status and error code.  Err is the
+// underlying cause, which gets logged but never shown to the client.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+	// Details holds any extra fields to include in JSON responses.
+	Details map[string]interface{}
+	// RetryAfter, if non-zero, is sent in a Retry-After header.
+	RetryAfter int
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // Err404 triggers a 404 response when thrown in a panic.
-var Err404 = errors.New("Not found")
+var Err404 = &Error{
+	Status:  http.StatusNotFound,
+	Code:    CodeNotFound,
+	Message: "Not found",
+}
+
+// Err405 triggers a 405 response when thrown in a panic.
+var Err405 = &Error{
+	Status:  http.StatusMethodNotAllowed,
+	Code:    CodeBadMethod,
+	Message: "Method not allowed",
+}
 
 // Err500 triggers a 500 response when thrown in a panic.
-var Err500 = errors.New("Internal error")
+var Err500 = &Error{
+	Status:  http.StatusInternalServerError,
+	Code:    CodeInternal,
+	Message: "Internal server error",
+}
+
+// BadRequest creates an error for a request the client got wrong.
+func BadRequest(message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeBadRequest,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// FieldError describes a problem with a single field of a request
+// body.  Field is the path to the field in the request's JSON, like
+// "source_lists[2].id".
+type FieldError = mix.FieldError
+
+// Invalid creates an error for a request body that failed validation,
+// listing every problem that was found with it.
+func Invalid(fields []FieldError) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidRequest,
+		Message: "The request failed validation",
+		Details: map[string]interface{}{"fields": fields},
+	}
+}
+
+// Unauthenticated creates an error for a request with a missing or
+// invalid session, which the client can fix by logging in again.
+func Unauthenticated(message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusUnauthorized,
+		Code:    CodeUnauthenticated,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// Forbidden creates an error for a request the user isn't allowed to
+// make.
+func Forbidden(message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusForbidden,
+		Code:    CodeForbidden,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// Upstream creates an error for a request that failed because the
+// Spotify API did.
+func Upstream(message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusBadGateway,
+		Code:    CodeUpstream,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// RateLimited creates an error for a request that was turned away
+// because we (or the Spotify API) are handling too many requests.
+// retryAfter is the number of seconds the client should wait, or 0 if
+// we don't know.
+func RateLimited(message string, retryAfter int, err error) *Error {
+	return &Error{
+		Status:     http.StatusTooManyRequests,
+		Code:       CodeRateLimited,
+		Message:    message,
+		Err:        err,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Unavailable creates an error for a request we can't handle right
+// now, like a new job while the server is shutting down.
+func Unavailable(message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeUnavailable,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// AsError converts whatever a handler panicked with into an *Error,
+// working out the right status for errors from the packages we call
+// out to.  Anything unrecognized becomes an internal server error.
+func AsError(recovered interface{}) *Error {
+	err, ok := recovered.(error)
+	if !ok {
+		err = fmt.Errorf("%v", recovered)
+	}
+
+	var handlerErr *Error
+	if errors.As(err, &handlerErr) {
+		return handlerErr
+	}
+
+	// This wraps the 403 Spotify sent, but deserves a clearer message
+	// than any other 403.
+	if errors.Is(err, spotify.ErrAudioFeaturesUnavailable) {
+		return Forbidden(spotify.ErrAudioFeaturesUnavailable.Error(), err)
+	}
+
+	var apiErr *spotify.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized:
+			return Unauthenticated("Spotify rejected the session", err)
+		case http.StatusForbidden:
+			return Forbidden("Spotify denied access", err)
+		case http.StatusNotFound:
+			return &Error{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: "Not found on Spotify",
+				Err:     err,
+			}
+		case http.StatusTooManyRequests:
+			return RateLimited(
+				"Spotify is rate limiting requests",
+				int(apiErr.RetryAfter.Seconds()),
+				err,
+			)
+		default:
+			return Upstream("Spotify API request failed", err)
+		}
+	}
+
+	var scopeErr spotify.MissingScopeError
+	if errors.As(err, &scopeErr) {
+		return Forbidden("Missing permissions for this feature", err)
+	}
+
+	if errors.Is(err, session.ErrExpired) {
+		return Unauthenticated("Session expired", err)
+	}
+	if errors.Is(err, session.ErrRevoked) {
+		return Unauthenticated("Session logged out", err)
+	}
+
+	return &Error{
+		Status:  Err500.Status,
+		Code:    Err500.Code,
+		Message: Err500.Message,
+		Err:     err,
+	}
+}
+
+// ErrorFormat selects how error responses are rendered.
+type ErrorFormat int
+
+// Error formats for WriteError.
+const (
+	// PlainErrors writes a bare line of text, and is meant as a last
+	// resort when something has gone wrong with the other formats.
+	PlainErrors ErrorFormat = iota
+	// HTMLErrors renders the error page template.
+	HTMLErrors
+	// JSONErrors writes a JSON object for API clients.
+	JSONErrors
+)
+
+// WriteError writes out an error response in the given format.
+func WriteError(
+	globalContext *context.GlobalContext,
+	format ErrorFormat,
+	w http.ResponseWriter,
+	r *http.Request,
+	e *Error,
+) {
+	requestID := context.RequestID(r.Context())
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+
+	switch format {
+	case JSONErrors:
+		body := map[string]interface{}{}
+		for key, value := range e.Details {
+			body[key] = value
+		}
+		body["code"] = e.Code
+		body["message"] = e.Message
+		body["request_id"] = requestID
+
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(body)
+
+	case HTMLErrors:
+		// Failing to build the static URI here shouldn't mask the
+		// original error, so the page just goes unstyled.
+		staticURI, _ := staticURI(globalContext)
+
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		w.WriteHeader(e.Status)
+		globalContext.Templates.Error.Execute(
+			w,
+			map[string]interface{}{
+				"status":     e.Status,
+				"statusText": http.StatusText(e.Status),
+				"code":       e.Code,
+				"message":    e.Message,
+				"requestID":  requestID,
+				"staticURI":  staticURI,
+			},
+		)
+
+	default:
+		w.Header().Set("Content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(e.Status)
+		fmt.Fprintf(w, "%d - %s", e.Status, http.StatusText(e.Status))
+	}
+}
 
-// FourOhFour writes out a standard page not found error message.
-func FourOhFour(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("404 - Not Found"))
+// NotFound panics with Err404, so the error catcher further up the
+// stack renders a not found error in whatever format it's set up for.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	panic(Err404)
 }
 
-// FiveHundred writes out a standard internal server error message.
-func FiveHundred(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte("500 - Internal Server Error"))
+// MethodNotAllowed panics with Err405, for routes that exist but
+// don't handle the request's method.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	panic(Err405)
 }
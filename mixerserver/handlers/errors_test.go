@@ -0,0 +1,59 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"testing"
+)
+
+func TestAsErrorSpotify(t *testing.T) {
+	forbidden := &spotify.Error{StatusCode: http.StatusForbidden}
+	tests := []struct {
+		name    string
+		err     error
+		message string
+	}{
+		{"forbidden", forbidden, "Spotify denied access"},
+		{
+			"audio features unavailable",
+			fmt.Errorf(
+				"%w (%w)",
+				spotify.ErrAudioFeaturesUnavailable,
+				forbidden,
+			),
+			spotify.ErrAudioFeaturesUnavailable.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := AsError(test.err)
+			if got.Status != http.StatusForbidden || got.Code != CodeForbidden {
+				t.Errorf("got %d %s, want 403", got.Status, got.Code)
+			}
+			if got.Message != test.message {
+				t.Errorf("got message %q, want %q", got.Message, test.message)
+			}
+		})
+	}
+}
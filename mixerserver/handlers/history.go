@@ -0,0 +1,174 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/history"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// defaultHistoryPageSize is the number of entries returned by a
+// history request that doesn't ask for a particular number.
+const defaultHistoryPageSize = 20
+
+// History returns a page of the user's past mixes as JSON, most
+// recent first.  The before query parameter continues from the next
+// ID given by the previous page, and limit sets the page size.
+func History(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		query := r.URL.Query()
+		limit := defaultHistoryPageSize
+		if limitParam := query.Get("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > history.MaxPageSize {
+				panic(BadRequest(
+					"limit must be between 1 and "+
+						strconv.Itoa(history.MaxPageSize),
+					err,
+				))
+			}
+		}
+
+		entries, next, err := history.List(
+			globalContext.Store,
+			userID,
+			query.Get("before"),
+			limit,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		response := map[string]interface{}{"entries": entries}
+		if next != "" {
+			response["next"] = next
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// HistoryEntry returns one of the user's past mixes as JSON, including
+// the tracks it wrote.
+func HistoryEntry(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		entry, err := history.Get(
+			globalContext.Store,
+			userID,
+			mux.Vars(r)["id"],
+		)
+		if errors.Is(err, history.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
+
+// Rerun starts a past mix again with the same request and seed.  By
+// default it mixes the sources' current tracks, but with the sources
+// query parameter set to snapshot it mixes the tracks the sources had
+// at the time, repeating the mix exactly.  The request is validated
+// again first, since the user may no longer own its playlists.
+func Rerun(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		authTokens := context.AuthTokens(ctx)
+
+		userID, err := spotify.GetUserID(ctx, authTokens)
+		if err != nil {
+			panic(err)
+		}
+
+		entry, err := history.Get(
+			globalContext.Store,
+			userID,
+			mux.Vars(r)["id"],
+		)
+		if errors.Is(err, history.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		rerun := history.Entry{
+			UserID:  userID,
+			Trigger: history.TriggerRerun,
+			RerunOf: entry.ID,
+			Request: entry.Request,
+		}
+		switch r.URL.Query().Get("sources") {
+		case "", "current":
+		case "snapshot":
+			if len(entry.SourceTrackIDs) != len(entry.Request.SourceLists) {
+				panic(BadRequest(
+					"This mix didn't record its sources' tracks",
+					nil,
+				))
+			}
+			rerun.FromSnapshot = true
+			rerun.SourceTrackIDs = entry.SourceTrackIDs
+		default:
+			panic(BadRequest("sources must be current or snapshot", nil))
+		}
+
+		if problems := entry.Request.Validate(); len(problems) != 0 {
+			panic(Invalid(problems))
+		}
+		problems, err := entry.Request.ValidateOwnership(
+			ctx,
+			authTokens,
+			userID,
+		)
+		if err != nil {
+			panic(err)
+		}
+		if len(problems) != 0 {
+			panic(Invalid(problems))
+		}
+
+		jobID := startMix(globalContext, r, rerun)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"job_id": jobID,
+		})
+	}
+}
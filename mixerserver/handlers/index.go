@@ -32,41 +32,38 @@ import (
 // Index renders the homepage.
 func Index(globalContext *context.GlobalContext) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		csrfData := map[string]string{
-			"User-Agent": r.Header.Get("User-Agent"),
-			"IP":         util.StripPort(r.RemoteAddr),
-		}
-		csrfPlaintext, err := json.Marshal(csrfData)
+		loginURI, err := newLoginURI(
+			globalContext,
+			r,
+			globalContext.Spotify.Scopes.For(
+				globalContext.Spotify.LoginFeatures...,
+			),
+		)
 		if err != nil {
 			panic(err)
 		}
-		csrfToken, err := crypto.Encrypt(string(csrfPlaintext))
 
-		loginCompletionURI, err := loginURI(globalContext, r.Host)
+		refreshURI, err := globalContext.Router.Get("refresh").URL()
 		if err != nil {
 			panic(err)
 		}
 
-		loginURI, err := spotify.GetLoginURI(
-			globalContext.Spotify.ClientID,
-			csrfToken,
-			loginCompletionURI,
-		)
+		playlistsURI, err := globalContext.Router.Get("playlists").URL()
 		if err != nil {
 			panic(err)
 		}
 
-		refreshURI, err := globalContext.Router.Get("refresh").URL()
+		submitURI, err := globalContext.Router.Get("submit").URL()
 		if err != nil {
 			panic(err)
 		}
 
-		playlistsURI, err := globalContext.Router.Get("playlists").URL()
+		logoutURI, err := globalContext.Router.Get("logout").URL()
 		if err != nil {
 			panic(err)
 		}
 
-		submitURI, err := globalContext.Router.Get("submit").URL()
+		staticURI, err := staticURI(globalContext)
 		if err != nil {
 			panic(err)
 		}
@@ -78,6 +75,8 @@ func Index(globalContext *context.GlobalContext) http.HandlerFunc {
 				"refreshURI":   refreshURI.String(),
 				"playlistsURI": playlistsURI.String(),
 				"submitURI":    submitURI.String(),
+				"logoutURI":    logoutURI.String(),
+				"staticURI":    staticURI,
 			},
 		)
 		if err != nil {
@@ -86,17 +85,79 @@ func Index(globalContext *context.GlobalContext) http.HandlerFunc {
 	}
 }
 
+// newLoginURI generates a Spotify login URI requesting the given
+// scopes, along with the encrypted CSRF state to validate the login
+// redirect against.
+func newLoginURI(
+	globalContext *context.GlobalContext,
+	r *http.Request,
+	scopes []string,
+) (*url.URL, error) {
+	// The PKCE verifier rides along in the encrypted CSRF state so
+	// we don't need to keep it anywhere server-side until the login
+	// redirect comes back.
+	codeVerifier, err := spotify.GenerateCodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	csrfData := map[string]string{
+		"User-Agent": r.Header.Get("User-Agent"),
+		"IP":         util.StripPort(r.RemoteAddr),
+		"Verifier":   codeVerifier,
+	}
+	csrfPlaintext, err := json.Marshal(csrfData)
+	if err != nil {
+		return nil, err
+	}
+	csrfToken, err := crypto.Encrypt(string(csrfPlaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	loginCompletionURI, err := loginURI(globalContext, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return spotify.GetLoginURI(
+		globalContext.Spotify.ClientID,
+		csrfToken,
+		codeVerifier,
+		scopes,
+		loginCompletionURI,
+	)
+}
+
 // loginURI assembles the login URI to redirect to from the Spotify
-// login API.
+// login API.  The scheme and host come from the configured public URL
+// if there is one, otherwise we assume https on whatever host the
+// request came in on.
 func loginURI(
 	globalContext *context.GlobalContext,
-	host string,
+	r *http.Request,
 ) (*url.URL, error) {
 	loginCompletionURI, err := globalContext.Router.Get("login").URL()
 	if err != nil {
 		return nil, err
 	}
-	loginCompletionURI.Scheme = "https"
-	loginCompletionURI.Host = host
+
+	if globalContext.PublicURL != nil {
+		loginCompletionURI.Scheme = globalContext.PublicURL.Scheme
+		loginCompletionURI.Host = globalContext.PublicURL.Host
+	} else {
+		loginCompletionURI.Scheme = "https"
+		loginCompletionURI.Host = r.Host
+	}
 	return loginCompletionURI, nil
 }
+
+// staticURI returns the path static resources are served under, for
+// templates to build their stylesheet, script and image links from.
+func staticURI(globalContext *context.GlobalContext) (string, error) {
+	uri, err := globalContext.Router.Get("static").URL()
+	if err != nil {
+		return "", err
+	}
+	return uri.String(), nil
+}
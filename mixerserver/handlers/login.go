@@ -21,9 +21,9 @@ package handlers
 
 import (
 	"encoding/json"
-	"errors"
 	"github.com/bieber/mixer/mixerserver/context"
 	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/session"
 	"github.com/bieber/mixer/mixerserver/spotify"
 	"github.com/bieber/mixer/mixerserver/util"
 	"net/http"
@@ -34,36 +34,48 @@ func Login(globalContext *context.GlobalContext) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		csrfJSON, err := crypto.Decrypt(r.URL.Query().Get("state"))
 		if err != nil {
-			panic(err)
+			panic(BadRequest("Invalid login state", err))
 		}
 
 		csrf := make(map[string]string)
 		err = json.Unmarshal([]byte(csrfJSON), &csrf)
 		if err != nil {
-			panic(err)
+			panic(BadRequest("Invalid login state", err))
 		}
 
 		if ip, ok := csrf["IP"]; !ok || ip != util.StripPort(r.RemoteAddr) {
-			panic(errors.New("CSRF mismatch"))
+			panic(Forbidden("CSRF mismatch", nil))
 		}
 		if a, ok := csrf["User-Agent"]; !ok || a != r.Header.Get("User-Agent") {
-			panic(errors.New("CSRF mismatch"))
+			panic(Forbidden("CSRF mismatch", nil))
+		}
+		codeVerifier, ok := csrf["Verifier"]
+		if !ok || codeVerifier == "" {
+			panic(BadRequest("Missing PKCE verifier", nil))
+		}
+
+		staticURI, err := staticURI(globalContext)
+		if err != nil {
+			panic(err)
 		}
 
 		data := map[string]interface{}{
-			"error": r.URL.Query().Get("error"),
+			"error":     r.URL.Query().Get("error"),
+			"staticURI": staticURI,
 		}
 
 		if r.URL.Query().Get("error") == "" {
-			redirectURI, err := loginURI(globalContext, r.Host)
+			redirectURI, err := loginURI(globalContext, r)
 			if err != nil {
 				panic(err)
 			}
 
 			tokens, err := spotify.GetAuthTokens(
+				r.Context(),
 				globalContext.Spotify.ClientID,
 				globalContext.Spotify.ClientSecret,
 				r.URL.Query().Get("code"),
+				codeVerifier,
 				redirectURI,
 			)
 
@@ -73,12 +85,15 @@ func Login(globalContext *context.GlobalContext) http.HandlerFunc {
 
 			data["expires_in"] = tokens.ExpiresIn
 
-			jsonToken, err := json.Marshal(tokens)
+			newSession, err := session.New(
+				tokens,
+				globalContext.Sessions.Lifetime,
+			)
 			if err != nil {
 				panic(err)
 			}
 
-			token, err := crypto.Encrypt(string(jsonToken))
+			token, err := newSession.Encode()
 			if err != nil {
 				panic(err)
 			}
@@ -96,10 +111,9 @@ func Login(globalContext *context.GlobalContext) http.HandlerFunc {
 // expired.
 func Refresh(globalContext *context.GlobalContext) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		localContext := context.Get(r)
-
 		tokens, err := spotify.RefreshAuthTokens(
-			localContext.AuthTokens,
+			r.Context(),
+			context.AuthTokens(r.Context()),
 			globalContext.Spotify.ClientID,
 			globalContext.Spotify.ClientSecret,
 		)
@@ -111,21 +125,37 @@ func Refresh(globalContext *context.GlobalContext) http.HandlerFunc {
 			"expires_in": tokens.ExpiresIn,
 		}
 
-		jsonToken, err := json.Marshal(tokens)
+		token, err := context.Session(r.Context()).Renew(tokens).Encode()
 		if err != nil {
 			panic(err)
 		}
+		data["token"] = token
 
-		token, err := crypto.Encrypt(string(jsonToken))
+		w.Header().Set("Content-type", "application/json")
+		err = json.NewEncoder(w).Encode(data)
 		if err != nil {
 			panic(err)
 		}
-		data["token"] = token
+	}
+}
 
-		w.Header().Set("Content-type", "application/json")
-		err = json.NewEncoder(w).Encode(data)
+// Logout ends the current session.  We don't keep any session state
+// of our own, so this just denies the session's nonce until it would
+// have expired anyway, which also stops its refresh token from being
+// used through the Refresh endpoint.
+func Logout(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := context.Session(r.Context())
+
+		err := globalContext.Sessions.DenyList.Deny(token)
 		if err != nil {
 			panic(err)
 		}
+		context.Logger(r.Context()).Info(
+			"logged out",
+			"session_expires", token.ExpiresAt(),
+		)
+
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
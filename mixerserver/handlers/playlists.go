@@ -29,13 +29,14 @@ import (
 // Playlists fetches and returns a list of the user's playlists as
 // JSON.
 func Playlists(w http.ResponseWriter, r *http.Request) {
-	localContext := context.Get(r)
+	ctx := r.Context()
+	authTokens := context.AuthTokens(ctx)
 
-	userID, err := spotify.GetUserID(localContext.AuthTokens)
+	userID, err := spotify.GetUserID(ctx, authTokens)
 	if err != nil {
 		panic(err)
 	}
-	playlists, err := spotify.GetPlaylists(localContext.AuthTokens, userID)
+	playlists, err := spotify.GetPlaylists(ctx, authTokens, userID)
 	if err != nil {
 		panic(err)
 	}
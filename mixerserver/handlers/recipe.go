@@ -0,0 +1,80 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/recipe"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"mime"
+	"net/http"
+)
+
+// recipeFormats maps the content types a recipe can be posted as to
+// the recipe format they carry.
+var recipeFormats = map[string]string{
+	"application/json":   "json",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"application/toml":   "toml",
+}
+
+// Recipe loads a recipe posted in the request body and returns it
+// resolved into a submission, with every playlist's ID and owner
+// filled in, ready to be posted to Submit.
+func Recipe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authTokens := context.AuthTokens(ctx)
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		panic(BadRequest("Missing or malformed Content-Type", err))
+	}
+	format, ok := recipeFormats[contentType]
+	if !ok {
+		panic(BadRequest("Recipes must be JSON, YAML or TOML", nil))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionSize)
+	loaded, err := recipe.Parse(r.Body, format)
+	if err != nil {
+		panic(BadRequest("Malformed recipe: "+err.Error(), err))
+	}
+
+	userID, err := spotify.GetUserID(ctx, authTokens)
+	if err != nil {
+		panic(err)
+	}
+	request, problems, err := loaded.Resolve(ctx, authTokens, userID)
+	if err != nil {
+		panic(err)
+	}
+	if len(problems) != 0 {
+		panic(Invalid(problems))
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	err = json.NewEncoder(w).Encode(request)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/schedule"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// maxScheduleNameLength caps the length of a schedule's name.
+const maxScheduleNameLength = 100
+
+type scheduleData struct {
+	Name    string      `json:"name"`
+	Cron    string      `json:"cron"`
+	Watch   bool        `json:"watch"`
+	Request mix.Request `json:"request"`
+}
+
+// Schedules lists the user's schedules as JSON.
+func Schedules(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		schedules, err := schedule.List(globalContext.Store, userID)
+		if err != nil {
+			panic(err)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"schedules": schedules,
+		})
+	}
+}
+
+// CreateSchedule sets up a new recurring mix, which will run with the
+// refresh token from the user's current session.  It runs on a cron
+// schedule, whenever its sources change, or both.
+func CreateSchedule(
+	globalContext *context.GlobalContext,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		authTokens := context.AuthTokens(ctx)
+
+		userID, err := spotify.GetUserID(ctx, authTokens)
+		if err != nil {
+			panic(err)
+		}
+
+		data := scheduleData{}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionSize)
+		err = json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			panic(BadRequest("Malformed schedule", err))
+		}
+
+		problems := []FieldError{}
+		if data.Name == "" {
+			problems = append(problems, FieldError{
+				Field:   "name",
+				Message: "A name is required",
+			})
+		} else if utf8.RuneCountInString(data.Name) > maxScheduleNameLength {
+			problems = append(problems, FieldError{
+				Field:   "name",
+				Message: "Name is too long",
+			})
+		}
+		if data.Cron != "" {
+			if _, err := schedule.ParseCron(data.Cron); err != nil {
+				problems = append(problems, FieldError{
+					Field:   "cron",
+					Message: "Invalid schedule: " + err.Error(),
+				})
+			}
+		} else if !data.Watch {
+			problems = append(problems, FieldError{
+				Field:   "cron",
+				Message: "A schedule is required unless watching sources",
+			})
+		}
+		problems = append(
+			problems,
+			prefixFields("request.", data.Request.Validate())...,
+		)
+		if len(problems) != 0 {
+			panic(Invalid(problems))
+		}
+
+		ownershipProblems, err := data.Request.ValidateOwnership(
+			ctx,
+			authTokens,
+			userID,
+		)
+		if err != nil {
+			panic(err)
+		}
+		if len(ownershipProblems) != 0 {
+			panic(Invalid(prefixFields("request.", ownershipProblems)))
+		}
+
+		created, err := schedule.Create(
+			globalContext.Store,
+			userID,
+			data.Name,
+			data.Cron,
+			data.Watch,
+			data.Request,
+			authTokens,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		context.Logger(ctx).Info(
+			"schedule created",
+			"schedule_id", created.ID,
+			"cron", created.Cron,
+			"watch", created.Watch,
+			"next_run", created.NextRun,
+		)
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// Schedule returns one of the user's schedules as JSON.
+func Schedule(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		found, err := schedule.Get(
+			globalContext.Store,
+			userID,
+			mux.Vars(r)["id"],
+		)
+		if errors.Is(err, schedule.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		writeJSON(w, http.StatusOK, found)
+	}
+}
+
+// DeleteSchedule removes one of the user's schedules.
+func DeleteSchedule(
+	globalContext *context.GlobalContext,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		err = schedule.Delete(globalContext.Store, userID, mux.Vars(r)["id"])
+		if errors.Is(err, schedule.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ScheduleRuns returns the run history of one of the user's schedules,
+// most recent first, along with when it will next run on its cron
+// schedule, if it has one.
+func ScheduleRuns(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		id := mux.Vars(r)["id"]
+		found, err := schedule.Get(globalContext.Store, userID, id)
+		if errors.Is(err, schedule.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		runs, err := schedule.Runs(globalContext.Store, userID, id)
+		if err != nil {
+			panic(err)
+		}
+
+		response := map[string]interface{}{"runs": runs}
+		if found.NextRun != nil {
+			response["next_run"] = found.NextRun.Format(time.RFC3339)
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// prefixFields prepends prefix to the field of every error.
+func prefixFields(prefix string, problems []FieldError) []FieldError {
+	for i := range problems {
+		problems[i].Field = prefix + problems[i].Field
+	}
+	return problems
+}
+
+// writeJSON sends value as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		panic(err)
+	}
+}
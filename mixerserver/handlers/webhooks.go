@@ -0,0 +1,166 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+type webhookData struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// Webhooks lists the user's webhooks as JSON.
+func Webhooks(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		hooks, err := webhook.List(globalContext.Store, userID)
+		if err != nil {
+			panic(err)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"webhooks": hooks,
+		})
+	}
+}
+
+// CreateWebhook registers a new webhook to notify about the user's
+// mixes.  The response includes the secret its requests are signed
+// with, which isn't shown again.
+func CreateWebhook(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := spotify.GetUserID(ctx, context.AuthTokens(ctx))
+		if err != nil {
+			panic(err)
+		}
+
+		data := webhookData{}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionSize)
+		err = json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			panic(BadRequest("Malformed webhook", err))
+		}
+
+		problems := []FieldError{}
+		if err := webhook.ValidateURL(data.URL); err != nil {
+			problems = append(problems, FieldError{
+				Field:   "url",
+				Message: "Invalid URL: " + err.Error(),
+			})
+		}
+		if err := webhook.ValidateEvents(data.Events); err != nil {
+			problems = append(problems, FieldError{
+				Field:   "events",
+				Message: "Invalid events: " + err.Error(),
+			})
+		}
+		if len(problems) != 0 {
+			panic(Invalid(problems))
+		}
+
+		hook, secret, err := webhook.Create(
+			globalContext.Store,
+			userID,
+			data.URL,
+			data.Events,
+		)
+		if errors.Is(err, webhook.ErrTooMany) {
+			panic(BadRequest(err.Error(), err))
+		} else if err != nil {
+			panic(err)
+		}
+
+		context.Logger(ctx).Info("webhook created", "webhook_id", hook.ID)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"webhook": hook,
+			"secret":  secret,
+		})
+	}
+}
+
+// DeleteWebhook removes one of the user's webhooks.
+func DeleteWebhook(globalContext *context.GlobalContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		err = webhook.Delete(globalContext.Store, userID, mux.Vars(r)["id"])
+		if errors.Is(err, webhook.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// WebhookDeliveries returns the delivery log of one of the user's
+// webhooks, most recent first.
+func WebhookDeliveries(
+	globalContext *context.GlobalContext,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := spotify.GetUserID(
+			r.Context(),
+			context.AuthTokens(r.Context()),
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		deliveries, err := webhook.Deliveries(
+			globalContext.Store,
+			userID,
+			mux.Vars(r)["id"],
+		)
+		if errors.Is(err, webhook.ErrNotFound) {
+			panic(Err404)
+		} else if err != nil {
+			panic(err)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"deliveries": deliveries,
+		})
+	}
+}
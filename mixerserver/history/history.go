@@ -0,0 +1,238 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package history keeps a record of the mixes the server runs, in the
+// store, so users can look back over what they've mixed and run it
+// again.
+package history
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"time"
+)
+
+const historyBucket = "history"
+
+// maxEntries is the number of mixes kept in each user's history.
+const maxEntries = 500
+
+// MaxPageSize is the most entries List will return at once.
+const MaxPageSize = 100
+
+// What started a mix, besides the triggers schedules use.
+const (
+	TriggerSubmit = "submit"
+	TriggerRerun  = "rerun"
+)
+
+// ErrNotFound is returned when an entry doesn't exist, or belongs to
+// someone else.
+var ErrNotFound = errors.New("Mix not found")
+
+// errPageFull stops iterating once List has all it needs.
+var errPageFull = errors.New("page full")
+
+// Entry records a single mix.  ScheduleID is set for mixes a schedule
+// ran, and RerunOf for mixes rerun from an earlier entry, with
+// FromSnapshot set if the rerun mixed the earlier entry's source
+// tracks rather than the sources' current ones.  The request's seed
+// is always filled in, and SourceTrackIDs holds the tracks mixed from
+// each source, so the mix can be repeated exactly.  Excluded and
+// Filtered count the source tracks left out because of the request's
+// exclusion playlists and filters.  Duration is in seconds.
+type Entry struct {
+	ID             string      `json:"id"`
+	UserID         string      `json:"user_id"`
+	JobID          string      `json:"job_id"`
+	Trigger        string      `json:"trigger"`
+	ScheduleID     string      `json:"schedule_id,omitempty"`
+	RerunOf        string      `json:"rerun_of,omitempty"`
+	FromSnapshot   bool        `json:"from_snapshot,omitempty"`
+	Request        mix.Request `json:"request"`
+	Started        time.Time   `json:"started"`
+	Finished       time.Time   `json:"finished"`
+	Duration       float64     `json:"duration"`
+	Outcome        string      `json:"outcome"`
+	Tracks         int         `json:"tracks"`
+	Excluded       int         `json:"excluded,omitempty"`
+	Filtered       int         `json:"filtered,omitempty"`
+	SourceTrackIDs [][]string  `json:"source_track_ids,omitempty"`
+	TrackIDs       []string    `json:"track_ids,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+// entryKey is the key an entry is stored under.  As with schedules,
+// a user's entries share the user ID and a slash as a prefix, and sort
+// in the order they were recorded.
+func entryKey(userID string, id string) string {
+	return userID + "/" + id
+}
+
+// RunJob runs a mix with mix.RunJob, records it in the user's
+// history and notifies any webhooks.  The entry should have its user,
+// trigger and request set, and the rest is filled in from the job.
+// If the entry already has source tracks, they're mixed in place of
+// the sources' current ones.
+func RunJob(
+	ctx gocontext.Context,
+	st *store.Store,
+	webhooks *webhook.Dispatcher,
+	authTokens spotify.AuthTokens,
+	entry Entry,
+) (mix.Result, error) {
+	entry.JobID = context.JobID(ctx)
+	entry.Started = time.Now()
+	if entry.Request.Options.Seed == 0 {
+		entry.Request.Options.Seed = mix.NewSeed()
+	}
+
+	result, err := mix.RunJob(
+		ctx,
+		authTokens,
+		entry.Request,
+		entry.SourceTrackIDs,
+	)
+
+	entry.Finished = time.Now()
+	entry.Duration = entry.Finished.Sub(entry.Started).Seconds()
+	entry.Outcome = mix.Outcome(err)
+	entry.Tracks = len(result.TrackIDs)
+	entry.Excluded = result.Excluded
+	entry.Filtered = result.Filtered
+	entry.TrackIDs = result.TrackIDs
+	if result.SourceTrackIDs != nil {
+		entry.SourceTrackIDs = result.SourceTrackIDs
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	recorded, recordErr := Record(st, entry)
+	if recordErr != nil {
+		context.Logger(ctx).Error("couldn't record mix", "error", recordErr)
+	}
+	webhooks.Notify(event(entry, recorded.ID))
+	return result, err
+}
+
+// event builds the webhook event for a finished mix.
+func event(entry Entry, id string) webhook.Event {
+	return webhook.Event{
+		Event:       "mix." + entry.Outcome,
+		HistoryID:   id,
+		JobID:       entry.JobID,
+		UserID:      entry.UserID,
+		Trigger:     entry.Trigger,
+		ScheduleID:  entry.ScheduleID,
+		Sources:     entry.Request.SourceIDs(),
+		Destination: entry.Request.DestList.ID,
+		DestinationURL: "https://open.spotify.com/playlist/" +
+			entry.Request.DestList.ID,
+		Tracks:   entry.Tracks,
+		Excluded: entry.Excluded,
+		Filtered: entry.Filtered,
+		Seed:     entry.Request.Options.Seed,
+		Started:  entry.Started,
+		Finished: entry.Finished,
+		Duration: entry.Duration,
+		Error:    entry.Error,
+	}
+}
+
+// Record adds an entry to its user's history, dropping the oldest
+// entries past maxEntries.
+func Record(st *store.Store, entry Entry) (Entry, error) {
+	id, err := st.NextID(historyBucket)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.ID = id
+
+	err = st.PutPruned(
+		historyBucket,
+		entryKey(entry.UserID, id),
+		entry,
+		entry.UserID+"/",
+		maxEntries,
+	)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// List returns a page of a user's history, most recent first, starting
+// after the entry with the ID before, or from the most recent if
+// before is empty.  The entries leave out their track lists.  If
+// there are more entries, next is the ID to pass as before to get
+// them.
+func List(
+	st *store.Store,
+	userID string,
+	before string,
+	limit int,
+) (entries []Entry, next string, err error) {
+	entries = []Entry{}
+	if before != "" {
+		before = entryKey(userID, before)
+	}
+
+	err = st.ForEachReverse(
+		historyBucket,
+		userID+"/",
+		before,
+		func(key string, value []byte) error {
+			if len(entries) == limit {
+				next = entries[len(entries)-1].ID
+				return errPageFull
+			}
+
+			entry := Entry{}
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				return err
+			}
+			entry.SourceTrackIDs = nil
+			entry.TrackIDs = nil
+			entries = append(entries, entry)
+			return nil
+		},
+	)
+	if errors.Is(err, errPageFull) {
+		err = nil
+	}
+	return
+}
+
+// Get returns one of a user's entries, including its track lists.
+func Get(st *store.Store, userID string, id string) (Entry, error) {
+	entry := Entry{}
+	err := st.Get(historyBucket, entryKey(userID, id), &entry)
+	if errors.Is(err, store.ErrNotFound) {
+		return entry, ErrNotFound
+	}
+	return entry, err
+}
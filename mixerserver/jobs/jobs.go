@@ -0,0 +1,119 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package jobs keeps track of the background mix jobs the server has
+// running, so that it can stop taking new ones and wait for the rest
+// to finish when it's shutting down.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when trying to start a job after the manager
+// has been closed.
+var ErrClosed = errors.New("Not accepting new jobs")
+
+// Manager tracks running jobs.  It is safe for concurrent use.
+type Manager struct {
+	mutex   sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+	nextID  int
+	cancels map[int]context.CancelFunc
+}
+
+// NewManager creates a Manager that's ready to accept jobs.
+func NewManager() *Manager {
+	return &Manager{cancels: map[int]context.CancelFunc{}}
+}
+
+// Start runs job in a new goroutine with a context derived from ctx,
+// which will be cancelled if the manager is closed while it's still
+// running.  Jobs should treat that as a request to stop at the next
+// point where they can do so without leaving anything half done, and
+// use context.WithoutCancel for any work that mustn't be interrupted.
+func (m *Manager) Start(ctx context.Context, job func(context.Context)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	id := m.nextID
+	m.nextID++
+	m.cancels[id] = cancel
+	m.running.Add(1)
+
+	go func() {
+		defer func() {
+			m.mutex.Lock()
+			delete(m.cancels, id)
+			m.mutex.Unlock()
+
+			cancel()
+			m.running.Done()
+		}()
+
+		job(jobCtx)
+	}()
+
+	return nil
+}
+
+// Close stops the manager from accepting any new jobs, and cancels
+// the contexts of the ones that are already running.
+func (m *Manager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+}
+
+// Closed checks whether the manager has been closed.
+func (m *Manager) Closed() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.closed
+}
+
+// Wait blocks until every running job has returned, or ctx is done,
+// in which case it returns ctx's error.  It should be called after
+// Close, otherwise new jobs may keep it waiting indefinitely.
+func (m *Manager) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
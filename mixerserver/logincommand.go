@@ -0,0 +1,232 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/config"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/credentials"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// loginResult is what the loopback listener hands back once the
+// Spotify login redirect arrives.
+type loginResult struct {
+	authTokens spotify.AuthTokens
+	err        error
+}
+
+// newLoginCommand creates the login command, which runs the browser
+// login once and saves the resulting tokens for the other client
+// commands to use.
+func newLoginCommand() *cobra.Command {
+	var port int
+	var timeout time.Duration
+
+	command := &cobra.Command{
+		Use:   "login",
+		Short: "Log in to Spotify and save a refresh token",
+		Long: `Log in to Spotify through the browser and save the tokens to the
+credentials file (credentials_file), for commands like mix to use
+without a browser.
+
+This prints a login URL to open, then waits for Spotify to redirect
+back to http://127.0.0.1:<port>/callback.  That redirect URI has to be
+registered with the Spotify app.`,
+		Args:    cobra.NoArgs,
+		PreRunE: bindConfigFlags,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLogin(port, timeout)
+		},
+	}
+
+	flags := command.Flags()
+	flags.IntVar(
+		&port,
+		"listen-port",
+		8888,
+		"loopback port to wait for the login redirect on",
+	)
+	flags.DurationVar(
+		&timeout,
+		"timeout",
+		5*time.Minute,
+		"how long to wait for the login to complete",
+	)
+	config.AddClientFlags(flags)
+
+	return command
+}
+
+// runLogin listens on the loopback interface for the login redirect,
+// exchanges the code it carries for tokens, and saves them.
+func runLogin(port int, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(
+		gocontext.Background(),
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	ctx, cancel := gocontext.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ctx, err := loadClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+	clientID := viper.GetString("spotify_client_id")
+
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+
+	// Nothing but the browser on this machine needs to reach the
+	// listener, so it's bound to the loopback address only.
+	listener, err := net.Listen(
+		"tcp",
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+	)
+	if err != nil {
+		return err
+	}
+	redirectURI := &url.URL{
+		Scheme: "http",
+		Host:   listener.Addr().String(),
+		Path:   "/callback",
+	}
+
+	codeVerifier, err := spotify.GenerateCodeVerifier()
+	if err != nil {
+		return err
+	}
+	state, err := crypto.GenerateNonce()
+	if err != nil {
+		return err
+	}
+	features := []spotify.Feature{
+		spotify.FeaturePlaylists,
+		spotify.FeatureMix,
+	}
+	loginURI, err := spotify.GetLoginURI(
+		clientID,
+		state,
+		codeVerifier,
+		config.FeatureScopes().For(features...),
+		redirectURI,
+	)
+	if err != nil {
+		return err
+	}
+
+	results := make(chan loginResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "Login state mismatch", http.StatusForbidden)
+			return
+		}
+
+		result := loginResult{}
+		if query.Get("error") != "" {
+			result.err = fmt.Errorf("login failed: %s", query.Get("error"))
+		} else {
+			result.authTokens, result.err = spotify.GetAuthTokens(
+				r.Context(),
+				clientID,
+				viper.GetString("spotify_client_secret"),
+				query.Get("code"),
+				codeVerifier,
+				redirectURI,
+			)
+		}
+
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadGateway)
+		} else {
+			fmt.Fprintln(w, "Logged in, you can close this window.")
+		}
+
+		select {
+		case results <- result:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Fprintf(
+		os.Stderr,
+		"Open this URL in your browser to log in:\n\n%s\n\n",
+		loginURI,
+	)
+
+	var result loginResult
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), gocontext.DeadlineExceeded) {
+			return errors.New("timed out waiting for the login redirect")
+		}
+		return ctx.Err()
+	}
+	if result.err != nil {
+		return result.err
+	}
+
+	userID, err := spotify.GetUserID(ctx, result.authTokens)
+	if err != nil {
+		return err
+	}
+
+	err = credentials.Save(path, credentials.Credentials{
+		AuthTokens: result.authTokens,
+		ClientID:   clientID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save credentials: %w", err)
+	}
+
+	context.Logger(ctx).Info(
+		"saved credentials",
+		"user", userID,
+		"path", path,
+		"scopes", result.authTokens.Scopes(),
+	)
+	return nil
+}
@@ -21,66 +21,165 @@ package main
 
 import (
 	"fmt"
-	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/config"
 	"github.com/bieber/mixer/mixerserver/crypto"
-	"github.com/spf13/viper"
-	"log"
-	"math/rand"
-	"net/http"
+	"github.com/spf13/cobra"
 	"os"
-	"time"
+	"runtime"
 )
 
+// version is the release the binary was built from, set at build
+// time with -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
-	rand.Seed(time.Now().Unix())
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
 
-	for _, flag := range os.Args {
-		if flag == "-k" || flag == "--key" {
-			key, err := crypto.GenerateAESKey()
-			if err != nil {
-				log.Fatal(err)
-			}
-			fmt.Println(key)
-			return
+// newRootCommand assembles the command tree.  Running the binary with
+// no subcommand serves, just like the serve command does.
+func newRootCommand() *cobra.Command {
+	serveCommand := newServeCommand()
+
+	root := &cobra.Command{
+		Use:   "mixerserver",
+		Short: "Mix Spotify playlists together",
+		Long: `mixerserver serves the playlist mixer web app, and can run mixes
+from the command line.
+
+Every config key can be set in a config file, as an upper-cased
+environment variable (SPOTIFY_CLIENT_ID), or as a command line flag
+(--spotify-client-id), with flags taking precedence.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		Version:      version,
+	}
+	config.AddFlags(root.Flags())
+
+	// -k used to be the only way to generate a key, so keep it
+	// working for anyone with it in their scripts.
+	root.Flags().BoolP("key", "k", false, "generate a token key and exit")
+	root.Flags().MarkHidden("key")
+	root.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if generate, _ := cmd.Flags().GetBool("key"); generate {
+			return nil
 		}
+		return serveCommand.PreRunE(cmd, args)
+	}
+	root.RunE = func(cmd *cobra.Command, args []string) error {
+		if generate, _ := cmd.Flags().GetBool("key"); generate {
+			return runKeygen()
+		}
+		return serveCommand.RunE(cmd, args)
 	}
 
-	viper.SetDefault("port", 80)
+	root.AddCommand(
+		serveCommand,
+		newKeygenCommand(),
+		newConfigCommand(),
+		newLoginCommand(),
+		newMixCommand(),
+		newVersionCommand(),
+	)
+	return root
+}
 
-	viper.BindEnv("port")
-	viper.BindEnv("static_path")
-	viper.BindEnv("spotify_client_id")
-	viper.BindEnv("spotify_client_secret")
-	viper.BindEnv("token_key")
+// newKeygenCommand creates the keygen command, which prints a fresh
+// value for the token_key setting.
+func newKeygenCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate a new token key",
+		Long: `Generate a random AES key suitable for the token_key setting and
+print it to stdout.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeygen()
+		},
+	}
+}
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath("/run/secrets")
-	err := viper.ReadInConfig()
+func runKeygen() error {
+	key, err := crypto.GenerateAESKey()
 	if err != nil {
-		log.Printf("Couldn't load config file: %s", err.Error())
+		return err
 	}
+	fmt.Println(key)
+	return nil
+}
 
-	crypto.SetAESKey(viper.GetString("token_key"))
+// newConfigCommand creates the config command, which only serves to
+// group its check subcommand.
+func newConfigCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server config",
+	}
 
-	globalContext := &context.GlobalContext{}
-	globalContext.Spotify.ClientID = viper.GetString("spotify_client_id")
-	globalContext.Spotify.ClientSecret = viper.GetString(
-		"spotify_client_secret",
-	)
+	check := &cobra.Command{
+		Use:   "check",
+		Short: "Validate the config without starting the server",
+		Long: `Load the config the same way serve would, and print every problem
+with it.  Exits non-zero if there are any.`,
+		Args:    cobra.NoArgs,
+		PreRunE: bindConfigFlags,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			if file := config.FileUsed(); file != "" {
+				fmt.Printf("%s: config OK\n", file)
+			} else {
+				fmt.Println(
+					"config OK (no config file found, using environment only)",
+				)
+			}
+			return nil
+		},
+	}
+	config.AddFlags(check.Flags())
 
-	initRoutes(globalContext, viper.GetString("static_path"))
+	command.AddCommand(check)
+	return command
+}
 
-	err = initTemplates(globalContext, viper.GetString("static_path"))
-	if err != nil {
-		log.Fatal(err)
+// newVersionCommand creates the version command.
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("mixerserver %s (%s)\n", version, runtime.Version())
+		},
 	}
+}
 
-	http.Handle("/", globalContext.Router)
+// bindConfigFlags binds a command's config flags into viper.  It's
+// meant to be used as the PreRunE of any command that loads the
+// config.
+func bindConfigFlags(cmd *cobra.Command, args []string) error {
+	return config.BindFlags(cmd.Flags())
+}
 
-	log.Printf("Starting server on port %d...", viper.GetInt("port"))
-	log.Fatal(
-		http.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt("port")), nil),
-	)
+// loadConfig loads and validates the config, printing every problem
+// it finds to stderr.
+func loadConfig() error {
+	err := config.Load()
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %w", err)
+	}
+
+	problems := config.Validate()
+	if len(problems) != 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", problem)
+		}
+		return fmt.Errorf("found %d config problem(s)", len(problems))
+	}
+	return nil
 }
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package metrics defines the Prometheus collectors the server
+// exports.  They're registered with the default registry, so they
+// show up through promhttp.Handler without any further setup.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "mixer"
+
+// HTTP server metrics, labelled with the name of the route that
+// handled the request.
+var (
+	HTTPRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests handled, by route, method and status.",
+		},
+		[]string{"route", "method", "code"},
+	)
+	HTTPDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+)
+
+// Spotify API client metrics, labelled with a short name for the
+// endpoint that was called.
+var (
+	SpotifyRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "spotify",
+			Name:      "requests_total",
+			Help:      "Spotify API calls, by endpoint, method and status.",
+		},
+		[]string{"endpoint", "method", "code"},
+	)
+	SpotifyDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "spotify",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of Spotify API calls, by endpoint and method.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"endpoint", "method"},
+	)
+	SpotifyRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "spotify",
+			Name:      "retries_total",
+			Help:      "Spotify API calls retried after a transient failure.",
+		},
+		[]string{"endpoint", "method"},
+	)
+)
+
+// Mix job metrics.
+var (
+	JobsRunning = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "mix",
+			Name:      "jobs_running",
+			Help:      "Mix jobs currently in progress.",
+		},
+	)
+	JobsFinished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mix",
+			Name:      "jobs_finished_total",
+			Help:      "Mix jobs finished, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+	TracksWritten = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mix",
+			Name:      "tracks_written_total",
+			Help:      "Tracks written to destination playlists.",
+		},
+	)
+)
+
+// Webhook metrics.
+var (
+	WebhookDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "webhook",
+			Name:      "deliveries_total",
+			Help:      "Webhook deliveries finished, by status.",
+		},
+		[]string{"status"},
+	)
+)
+
+// Job outcomes for the JobsFinished counter.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeCancelled = "cancelled"
+)
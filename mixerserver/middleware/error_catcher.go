@@ -25,27 +25,34 @@ import (
 	"net/http"
 )
 
-// ErrorCatcher retrieves any error-codes that a controller may panic
-// with and delegates to the corresponding error controller.
-func ErrorCatcher(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			localContext := context.Get(r)
+// ErrorCatcher recovers from any panic further down the stack and
+// renders it as an error response in the given format.  Controllers
+// can panic with a *handlers.Error to choose the status and error
+// code, anything else is classified by handlers.AsError.
+func ErrorCatcher(
+	globalContext *context.GlobalContext,
+	format handlers.ErrorFormat,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
 
-			err := recover()
-			if err == nil {
-				return
-			}
+				err := handlers.AsError(recovered)
+				log := context.Logger(r.Context())
+				if err.Status >= http.StatusInternalServerError {
+					log.Error("panic", "code", err.Code, "error", err)
+				} else {
+					log.Info("request failed", "code", err.Code, "error", err)
+				}
 
-			switch err {
-			case handlers.Err404:
-				handlers.FourOhFour(w, r)
-			default:
-				localContext.Logger.Printf("PANIC: %v", err)
-				handlers.FiveHundred(w, r)
-			}
-		}()
+				handlers.WriteError(globalContext, format, w, r, err)
+			}()
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
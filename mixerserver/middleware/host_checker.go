@@ -0,0 +1,64 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package middleware
+
+import (
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/handlers"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostChecker rejects any request whose Host header isn't in the
+// configured allow-list.  An entry without a port matches that host on
+// any port.  If the allow-list is empty every host is accepted.
+func HostChecker(
+	globalContext *context.GlobalContext,
+) func(http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, host := range globalContext.AllowedHosts {
+		allowed[strings.ToLower(host)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(allowed) != 0 && !hostAllowed(allowed, r.Host) {
+				panic(handlers.BadRequest("Unrecognized host", nil))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hostAllowed checks a Host header against the allow-list, first as
+// given and then with any port removed.
+func hostAllowed(allowed map[string]bool, host string) bool {
+	host = strings.ToLower(host)
+	if allowed[host] {
+		return true
+	}
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	return allowed[hostname] || allowed["["+hostname+"]"]
+}
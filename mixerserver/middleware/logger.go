@@ -20,45 +20,63 @@
 package middleware
 
 import (
-	"github.com/bieber/logger"
 	"github.com/bieber/mixer/mixerserver/context"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
-	"os"
-	"sync"
 	"time"
 )
 
-var loggerMutex = sync.Mutex{}
-
-// Logger wraps a handler with basic HTTP logging
+// Logger wraps a handler with basic HTTP logging.  It attaches a
+// logger tagged with the request ID to the request's context, so it
+// must come after RequestID in the stack.
 func Logger(
 	globalContext *context.GlobalContext,
 ) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			localContext := context.Get(r)
-			localContext.Logger = logger.New()
+			requestLog := globalContext.Logger.With(
+				"request_id",
+				context.RequestID(r.Context()),
+			)
+			spanContext := trace.SpanContextFromContext(r.Context())
+			if spanContext.IsValid() {
+				requestLog = requestLog.With(
+					"trace_id",
+					spanContext.TraceID().String(),
+				)
+			}
+			r = r.WithContext(context.WithLogger(r.Context(), requestLog))
 
 			t0 := time.Now()
-			localContext.Logger.WriteString("====\n")
-			localContext.Logger.Printf(
-				"[%s] %s %s",
-				r.Method,
-				r.RemoteAddr,
-				r.URL.String(),
+			requestLog.Debug(
+				"request started",
+				"method", r.Method,
+				"remote_addr", r.RemoteAddr,
+				"path", r.URL.Path,
 			)
 
-			next.ServeHTTP(w, r)
-
-			localContext.Logger.Printf("FINISHED IN %v", time.Now().Sub(t0))
-
-			loggerMutex.Lock()
-			_, err := localContext.Logger.WriteTo(os.Stderr)
-			loggerMutex.Unlock()
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, r)
 
-			if err != nil {
-				panic(err)
-			}
+			requestLog.Log(
+				r.Context(),
+				levelForStatus(recorder.status),
+				"request finished",
+				"method", r.Method,
+				"remote_addr", r.RemoteAddr,
+				"path", r.URL.Path,
+				"status", recorder.status,
+				"duration", time.Now().Sub(t0),
+			)
 		})
 	}
 }
+
+// levelForStatus picks the level to log a finished request at.
+func levelForStatus(status int) slog.Level {
+	if status >= http.StatusInternalServerError {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package middleware
+
+import (
+	"github.com/bieber/mixer/mixerserver/metrics"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics records request counts and latencies for each named route.
+// Requests that didn't match a route at all are counted under
+// "not_found", and unnamed routes under "other".
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "not_found"
+		if current := mux.CurrentRoute(r); current != nil {
+			route = current.GetName()
+			if route == "" {
+				route = "other"
+			}
+		}
+
+		t0 := time.Now()
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		metrics.HTTPDuration.WithLabelValues(route).
+			Observe(time.Now().Sub(t0).Seconds())
+		metrics.HTTPRequests.WithLabelValues(
+			route,
+			r.Method,
+			strconv.Itoa(recorder.status),
+		).Inc()
+	})
+}
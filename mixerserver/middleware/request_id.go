@@ -0,0 +1,52 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package middleware
+
+import (
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// RequestIDHeader is the response header the request ID is returned
+// in.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID generates a random ID for each request, attaches it to
+// the request's context and returns it to the client in the
+// X-Request-ID header.  If the request is being traced, the ID is
+// also recorded on its span.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID, err := crypto.GenerateNonce()
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("mixer.request_id", requestID),
+		)
+		r = r.WithContext(context.WithRequestID(r.Context(), requestID))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package middleware
+
+import (
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/handlers"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+)
+
+// ScopeChecker makes sure the parsed auth tokens were granted every
+// scope the given features need, and asks the user for additional
+// consent instead of running the next handler if they weren't.  It
+// must come after TokenParser in the stack.
+func ScopeChecker(
+	globalContext *context.GlobalContext,
+	features ...spotify.Feature,
+) func(http.Handler) http.Handler {
+	scopes := globalContext.Spotify.Scopes.For(features...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authTokens := context.AuthTokens(r.Context())
+
+			missing := authTokens.MissingScopes(scopes...)
+			if len(missing) != 0 {
+				handlers.ConsentRequired(globalContext, missing)(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package middleware
+
+import (
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"time"
+)
+
+// requestRetryLimit is how long a request may spend in total waiting
+// to retry rate limited or failed Spotify calls.
+const requestRetryLimit = 5 * time.Second
+
+// SpotifyRetryLimit keeps Spotify calls made while serving a request
+// from waiting out long rate limits, so the client gets a
+// rate_limited error it can act on instead of a hung request.  Jobs
+// the request starts aren't affected, since they run on a detached
+// context.
+func SpotifyRetryLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(
+			spotify.WithRetryLimit(r.Context(), requestRetryLimit),
+		)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -20,37 +20,34 @@
 package middleware
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/bieber/mixer/mixerserver/context"
-	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/handlers"
+	"github.com/bieber/mixer/mixerserver/session"
 	"net/http"
 )
 
 // TokenParser looks for a "token" GET parameter, decrypts and parses
-// it, and kills the request if anything fails along the way.
-func TokenParser(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		localContext := context.Get(r)
+// it, and kills the request if anything fails along the way,
+// including the session having expired or been logged out.
+func TokenParser(
+	globalContext *context.GlobalContext,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := session.Decode(
+				r.URL.Query().Get("token"),
+				globalContext.Sessions.DenyList,
+			)
+			if errors.Is(err, session.ErrExpired) ||
+				errors.Is(err, session.ErrRevoked) {
+				panic(err)
+			} else if err != nil {
+				panic(handlers.Unauthenticated("Invalid session token", err))
+			}
 
-		token := r.URL.Query().Get("token")
-		decryptedToken, err := crypto.Decrypt(token)
-		if err != nil {
-			panic(err)
-		}
-
-		err = json.Unmarshal([]byte(decryptedToken), &localContext.AuthTokens)
-		if err != nil {
-			panic(err)
-		}
-
-		if localContext.AuthTokens.AccessToken == "" {
-			panic(errors.New("Missing access token"))
-		}
-		if localContext.AuthTokens.RefreshToken == "" {
-			panic(errors.New("Missing refresh token"))
-		}
-
-		next.ServeHTTP(w, r)
-	})
+			r = r.WithContext(context.WithSession(r.Context(), token))
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package middleware
+
+import (
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net/http"
+)
+
+// Tracing starts a server span for each request, named after the
+// route that handled it.  Any spans started further down the stack
+// (including those for Spotify API calls) become its children.
+func Tracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(
+		next,
+		"http",
+		otelhttp.WithSpanNameFormatter(
+			func(operation string, r *http.Request) string {
+				if current := mux.CurrentRoute(r); current != nil {
+					if name := current.GetName(); name != "" {
+						return r.Method + " " + name
+					}
+				}
+				return r.Method
+			},
+		),
+	)
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// trackLists sorts source playlists by length, keeping each one's
+// weight alongside it.
+type trackLists struct {
+	trackIDs [][]string
+	weights  []int
+}
+
+// Combine merges the tracks from each source playlist into a single
+// list according to options.  weights gives the number of tracks to
+// take from each source on its turn when mixing round robin, and may
+// be nil to take one track from each.  The same sources, weights and
+// options always combine the same way.
+func Combine(
+	sourceTrackIDs [][]string,
+	weights []int,
+	options Options,
+) []string {
+	if weights == nil {
+		weights = make([]int, len(sourceTrackIDs))
+	}
+	weights = normalizeWeights(weights)
+	// Sorting below shouldn't reorder the caller's sources.
+	sourceTrackIDs = append([][]string{}, sourceTrackIDs...)
+
+	if options.Dedup {
+		// Shorter lists get first claim on any duplicated tracks.
+		sort.Sort(trackLists{sourceTrackIDs, weights})
+		sourceTrackIDs = dedupSourceTracks(sourceTrackIDs)
+	}
+	// Empty sources (whether they started that way or were emptied
+	// by deduping) have nothing to contribute, and would otherwise
+	// trip up the modular arithmetic below.
+	sourceTrackIDs, weights = dropEmptySourceTracks(sourceTrackIDs, weights)
+	if len(sourceTrackIDs) == 0 {
+		return []string{}
+	}
+	if options.Shuffle {
+		sourceTrackIDs = shuffleSourceTracks(
+			sourceTrackIDs,
+			options.Pad,
+			rand.New(rand.NewSource(options.Seed)),
+		)
+	}
+	// If both Pad and Shuffle were set, the tracks have already been
+	// shuffled and padded
+	if options.Pad && !options.Shuffle {
+		sourceTrackIDs = padSourceTracks(sourceTrackIDs)
+	}
+
+	totalLength := 0
+	for _, list := range sourceTrackIDs {
+		totalLength += len(list)
+	}
+	destList := make([]string, totalLength)
+
+	srcList := 0
+	srcPositions := make([]int, len(sourceTrackIDs))
+	// taken counts the tracks taken from srcList on its current turn.
+	taken := 0
+
+	for i := range destList {
+		destList[i] = sourceTrackIDs[srcList][srcPositions[srcList]]
+		if i == len(destList)-1 {
+			break
+		}
+
+		srcPositions[srcList]++
+		taken++
+		if options.RoundRobin && taken >= weights[srcList] {
+			srcList = (srcList + 1) % len(sourceTrackIDs)
+			taken = 0
+		}
+		for srcPositions[srcList] >= len(sourceTrackIDs[srcList]) {
+			srcList = (srcList + 1) % len(sourceTrackIDs)
+			taken = 0
+		}
+	}
+
+	return destList
+}
+
+// normalizeWeights returns a copy of weights with anything less than
+// one (including unset weights) raised to one.
+func normalizeWeights(weights []int) []int {
+	normalized := make([]int, len(weights))
+	for i, weight := range weights {
+		normalized[i] = weight
+		if weight < 1 {
+			normalized[i] = 1
+		}
+	}
+	return normalized
+}
+
+func dropEmptySourceTracks(
+	sourceTrackIDs [][]string,
+	weights []int,
+) ([][]string, []int) {
+	nonEmpty := [][]string{}
+	nonEmptyWeights := []int{}
+	for i, list := range sourceTrackIDs {
+		if len(list) != 0 {
+			nonEmpty = append(nonEmpty, list)
+			nonEmptyWeights = append(nonEmptyWeights, weights[i])
+		}
+	}
+	return nonEmpty, nonEmptyWeights
+}
+
+// dedupSourceTracks drops every track that already appeared in an
+// earlier source.
+func dedupSourceTracks(sourceTrackIDs [][]string) [][]string {
+	seenIDs := map[string]bool{}
+	deduped := [][]string{}
+
+	for _, list := range sourceTrackIDs {
+		newList := []string{}
+
+		for _, track := range list {
+			if _, ok := seenIDs[track]; ok {
+				continue
+			}
+
+			seenIDs[track] = true
+			newList = append(newList, track)
+		}
+
+		deduped = append(deduped, newList)
+	}
+
+	return deduped
+}
+
+// If a list is being both padded and shuffled, the padding needs to
+// happen at the same time as the shuffling so we can make sure not to
+// include duplicates before the entire list has been exhausted.
+func shuffleSourceTracks(
+	sourceTrackIDs [][]string,
+	pad bool,
+	rng *rand.Rand,
+) [][]string {
+	maxLength := 0
+	for _, list := range sourceTrackIDs {
+		if len(list) > maxLength {
+			maxLength = len(list)
+		}
+	}
+
+	shuffled := [][]string{}
+	for _, sourceList := range sourceTrackIDs {
+		targetLength := len(sourceList)
+		if pad {
+			targetLength = maxLength
+		}
+		destList := make([]string, targetLength, targetLength)
+
+		for i := range destList {
+			modLen := i % len(sourceList)
+			baseChars := (i / len(sourceList)) * len(sourceList)
+			srcPos := i % len(sourceList)
+
+			j := baseChars + rng.Intn(modLen+1)
+
+			if j == i {
+				destList[i] = sourceList[srcPos]
+			} else {
+				destList[i] = destList[j]
+				destList[j] = sourceList[srcPos]
+			}
+		}
+
+		shuffled = append(shuffled, destList)
+	}
+
+	return shuffled
+}
+
+func padSourceTracks(sourceTrackIDs [][]string) [][]string {
+	maxLength := 0
+	for _, list := range sourceTrackIDs {
+		if len(list) > maxLength {
+			maxLength = len(list)
+		}
+	}
+
+	padded := [][]string{}
+	for _, sourceList := range sourceTrackIDs {
+		newList := make([]string, maxLength)
+		for i := range newList {
+			newList[i] = sourceList[i%len(sourceList)]
+		}
+		padded = append(padded, newList)
+	}
+
+	return padded
+}
+
+func (ls trackLists) Len() int {
+	return len(ls.trackIDs)
+}
+
+func (ls trackLists) Less(i, j int) bool {
+	return len(ls.trackIDs[i]) < len(ls.trackIDs[j])
+}
+
+func (ls trackLists) Swap(i, j int) {
+	ls.trackIDs[i], ls.trackIDs[j] = ls.trackIDs[j], ls.trackIDs[i]
+	ls.weights[i], ls.weights[j] = ls.weights[j], ls.weights[i]
+}
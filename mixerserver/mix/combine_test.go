@@ -0,0 +1,189 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mix
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCombine(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources [][]string
+		weights []int
+		options Options
+		want    []string
+	}{
+		{
+			name:    "concatenate",
+			sources: [][]string{{"a", "b"}, {"c", "d"}},
+			want:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "round robin",
+			sources: [][]string{{"a", "b", "c"}, {"d", "e"}},
+			options: Options{RoundRobin: true},
+			want:    []string{"a", "d", "b", "e", "c"},
+		},
+		{
+			name:    "weighted round robin",
+			sources: [][]string{{"a", "b", "c", "d"}, {"e", "f"}},
+			weights: []int{2, 1},
+			options: Options{RoundRobin: true},
+			want:    []string{"a", "b", "e", "c", "d", "f"},
+		},
+		{
+			name:    "unset weights count as one",
+			sources: [][]string{{"a", "b"}, {"c", "d"}},
+			weights: []int{0, -3},
+			options: Options{RoundRobin: true},
+			want:    []string{"a", "c", "b", "d"},
+		},
+		{
+			name:    "weights ignored without round robin",
+			sources: [][]string{{"a", "b"}, {"c"}},
+			weights: []int{1, 5},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			// Dedup sorts the shorter source first, so it claims "b"
+			// and its weight moves along with it.
+			name:    "dedup reorders sources with their weights",
+			sources: [][]string{{"a", "b", "c", "d"}, {"b", "e"}},
+			weights: []int{3, 1},
+			options: Options{RoundRobin: true, Dedup: true},
+			want:    []string{"b", "a", "c", "d", "e"},
+		},
+		{
+			name:    "dedup empties a source",
+			sources: [][]string{{"a", "b"}, {"a"}},
+			options: Options{RoundRobin: true, Dedup: true},
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "empty sources",
+			sources: [][]string{{}, {"a", "b"}, {}, {"c"}},
+			weights: []int{5, 1, 5, 1},
+			options: Options{RoundRobin: true},
+			want:    []string{"a", "c", "b"},
+		},
+		{
+			name:    "all sources empty",
+			sources: [][]string{{}, {}},
+			options: Options{RoundRobin: true, Pad: true, Shuffle: true},
+			want:    []string{},
+		},
+		{
+			name:    "no sources",
+			sources: [][]string{},
+			want:    []string{},
+		},
+		{
+			name:    "pad",
+			sources: [][]string{{"a", "b", "c"}, {"d"}},
+			options: Options{RoundRobin: true, Pad: true},
+			want:    []string{"a", "d", "b", "d", "c", "d"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Combine(test.sources, test.weights, test.options)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCombineSingleSource(t *testing.T) {
+	tracks := [][]string{{"a", "b", "c"}}
+	combined := Combine(
+		tracks,
+		[]int{1},
+		Options{RoundRobin: true, Pad: true, Seed: 1},
+	)
+	if fmt.Sprint(combined) != "[a b c]" {
+		t.Errorf("got %v, want [a b c]", combined)
+	}
+}
+
+func TestCombineDoesNotReorderSources(t *testing.T) {
+	sources := [][]string{{"a", "b", "c"}, {"d"}}
+	Combine(sources, []int{2, 1}, Options{Dedup: true, RoundRobin: true})
+	if fmt.Sprint(sources) != "[[a b c] [d]]" {
+		t.Errorf("sources reordered to %v", sources)
+	}
+}
+
+func TestCombinePadShuffle(t *testing.T) {
+	sources := [][]string{{"a", "b", "c", "d", "e"}, {"x", "y"}}
+	for seed := int64(1); seed <= 50; seed++ {
+		got := Combine(
+			sources,
+			nil,
+			Options{Pad: true, Shuffle: true, Seed: seed},
+		)
+		if len(got) != 10 {
+			t.Fatalf("seed %d: got %d tracks, want 10", seed, len(got))
+		}
+
+		// Without round robin the padded sources come one after the
+		// other.  Each must use every one of its tracks before
+		// repeating any.
+		counts := map[string]int{}
+		for _, track := range got[:5] {
+			counts[track]++
+		}
+		for _, track := range sources[0] {
+			if counts[track] != 1 {
+				t.Errorf("seed %d: %v repeats a track", seed, got[:5])
+			}
+		}
+		padded := got[5:]
+		for i := 0; i+1 < len(padded); i += 2 {
+			if padded[i] == padded[i+1] {
+				t.Errorf("seed %d: %v repeats too soon", seed, padded)
+			}
+		}
+	}
+}
+
+func TestCombineSameSeed(t *testing.T) {
+	sources := [][]string{
+		{"a", "b", "c", "d", "e", "f"},
+		{"c", "g", "h"},
+		{"i", "j"},
+	}
+	options := Options{
+		RoundRobin: true,
+		Shuffle:    true,
+		Dedup:      true,
+		Pad:        true,
+	}
+	for seed := int64(1); seed <= 20; seed++ {
+		options.Seed = seed
+		first := Combine(sources, []int{2, 1, 1}, options)
+		second := Combine(sources, []int{2, 1, 1}, options)
+		if fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Errorf("seed %d: got %v, then %v", seed, first, second)
+		}
+	}
+}
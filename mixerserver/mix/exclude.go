@@ -0,0 +1,118 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/tracing"
+)
+
+// excluder knows which tracks, and optionally which artists, to leave
+// out of a mix.
+type excluder struct {
+	trackIDs  map[string]bool
+	artistIDs map[string]bool
+}
+
+// fetchExclusions fetches the tracks on each of the request's
+// exclusion playlists, along with their artists if the request
+// excludes artists too.
+func fetchExclusions(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	request Request,
+) (excluder, error) {
+	log := context.Logger(ctx)
+
+	ctx, span := tracing.Tracer.Start(ctx, "fetch exclusions")
+	defer span.End()
+
+	e := excluder{trackIDs: map[string]bool{}, artistIDs: map[string]bool{}}
+	for _, list := range request.ExcludeLists {
+		tracks, err := spotify.GetPlaylistTracks(
+			ctx,
+			authTokens,
+			list.OwnerID,
+			list.ID,
+		)
+		if err != nil {
+			return excluder{}, err
+		}
+
+		// Local files don't have IDs, and shouldn't exclude every
+		// other local file.
+		for _, track := range tracks {
+			if track.ID != "" {
+				e.trackIDs[track.ID] = true
+			}
+			if !request.Options.ExcludeArtists {
+				continue
+			}
+			for _, artist := range track.Artists {
+				if artist.ID != "" {
+					e.artistIDs[artist.ID] = true
+				}
+			}
+		}
+
+		log.Info(
+			"fetched exclusion playlist",
+			"playlist", list.ID,
+			"tracks", len(tracks),
+		)
+	}
+	return e, nil
+}
+
+// excludes reports whether track should be left out.
+func (e excluder) excludes(track spotify.Track) bool {
+	if e.trackIDs[track.ID] {
+		return true
+	}
+	for _, artist := range track.Artists {
+		if e.artistIDs[artist.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// apply drops excluded tracks from each source, returning what's left
+// along with the number of tracks dropped.
+func (e excluder) apply(
+	sourceTracks [][]spotify.Track,
+) ([][]spotify.Track, int) {
+	excluded := 0
+	kept := [][]spotify.Track{}
+	for _, tracks := range sourceTracks {
+		keptTracks := []spotify.Track{}
+		for _, track := range tracks {
+			if e.excludes(track) {
+				excluded++
+				continue
+			}
+			keptTracks = append(keptTracks, track)
+		}
+		kept = append(kept, keptTracks)
+	}
+	return kept, excluded
+}
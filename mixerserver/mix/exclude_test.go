@@ -0,0 +1,156 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"testing"
+)
+
+// track returns a track with the given ID by the artists with the
+// given IDs.
+func track(id string, artistIDs ...string) spotify.Track {
+	track := spotify.Track{ID: id}
+	for _, artistID := range artistIDs {
+		track.Artists = append(track.Artists, spotify.Artist{ID: artistID})
+	}
+	return track
+}
+
+func TestExcluderApply(t *testing.T) {
+	sources := [][]spotify.Track{
+		{track("a", "x"), track("b", "y"), track("c", "x", "z")},
+		{track("d", "w"), track("a", "x")},
+	}
+
+	tests := []struct {
+		name     string
+		excluder excluder
+		want     string
+		excluded int
+	}{
+		{
+			name:     "nothing excluded",
+			excluder: excluder{},
+			want:     "[[a b c] [d a]]",
+		},
+		{
+			name:     "tracks",
+			excluder: excluder{trackIDs: map[string]bool{"a": true}},
+			want:     "[[b c] [d]]",
+			excluded: 2,
+		},
+		{
+			name:     "artists",
+			excluder: excluder{artistIDs: map[string]bool{"x": true}},
+			want:     "[[b] [d]]",
+			excluded: 3,
+		},
+		{
+			name:     "any of a track's artists",
+			excluder: excluder{artistIDs: map[string]bool{"z": true}},
+			want:     "[[a b] [d a]]",
+			excluded: 1,
+		},
+		{
+			name: "tracks and artists",
+			excluder: excluder{
+				trackIDs:  map[string]bool{"b": true},
+				artistIDs: map[string]bool{"w": true},
+			},
+			want:     "[[a c] [a]]",
+			excluded: 2,
+		},
+		{
+			name: "empties a source",
+			excluder: excluder{
+				artistIDs: map[string]bool{"w": true, "x": true},
+			},
+			want:     "[[b] []]",
+			excluded: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept, excluded := test.excluder.apply(sources)
+			if got := fmt.Sprint(trackIDs(kept)); got != test.want {
+				t.Errorf("kept %s, want %s", got, test.want)
+			}
+			if excluded != test.excluded {
+				t.Errorf("excluded %d, want %d", excluded, test.excluded)
+			}
+		})
+	}
+}
+
+func TestFetchExclusionsSkipsLocalFiles(t *testing.T) {
+	// The exclusion playlist has a local file, which has no ID and
+	// whose artist has no ID either.
+	t.Cleanup(spotify.StubAPI(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			items := []map[string]spotify.Track{
+				{"track": track("a", "x")},
+				{"track": track("", "")},
+			}
+			json.NewEncoder(w).Encode(
+				map[string]interface{}{"items": items},
+			)
+		},
+	)))
+
+	for _, excludeArtists := range []bool{false, true} {
+		name := fmt.Sprint("exclude artists ", excludeArtists)
+		t.Run(name, func(t *testing.T) {
+			request := Request{
+				ExcludeLists: []List{{ID: "exclude", OwnerID: "me"}},
+				Options:      Options{ExcludeArtists: excludeArtists},
+			}
+			e, err := fetchExclusions(
+				gocontext.Background(),
+				spotify.AuthTokens{AccessToken: "token"},
+				request,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			local := track("", "")
+			if e.excludes(local) {
+				t.Error("local file excluded by another local file")
+			}
+			if !e.excludes(track("a")) {
+				t.Error("track on the exclusion playlist not excluded")
+			}
+			byArtist := e.excludes(track("b", "x"))
+			if byArtist != excludeArtists {
+				t.Errorf(
+					"track by an excluded artist excluded %v, want %v",
+					byArtist,
+					excludeArtists,
+				)
+			}
+		})
+	}
+}
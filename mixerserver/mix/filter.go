@@ -0,0 +1,318 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MaxPopularity is the highest popularity Spotify gives a track.
+const MaxPopularity = 100
+
+// MaxTempo is the highest tempo, in beats per minute, a filter can
+// ask for.  Anything faster than this is really a misdetection.
+const MaxTempo = 500
+
+// Filters narrows each source down to the tracks that match before
+// the sources are combined.  Zero values don't filter, and the
+// minimums and maximums are inclusive.  Durations are in seconds,
+// compared against the track's exact length, so a maximum of 180
+// leaves out a track 180.5 seconds long.  Tempos are in beats per
+// minute, and the other audio features run from 0 to 1.  Tracks with
+// no known release year never match a year range, and tracks with no
+// audio features never match an audio feature range.  Newer Spotify
+// apps can't fetch audio features at all, in which case mixes using
+// any of those ranges fail with spotify.ErrAudioFeaturesUnavailable.
+type Filters struct {
+	ExcludeExplicit     bool    `json:"exclude_explicit"`
+	MinYear             int     `json:"min_year,omitempty"`
+	MaxYear             int     `json:"max_year,omitempty"`
+	MinPopularity       int     `json:"min_popularity,omitempty"`
+	MaxPopularity       int     `json:"max_popularity,omitempty"`
+	MinDuration         int     `json:"min_duration,omitempty"`
+	MaxDuration         int     `json:"max_duration,omitempty"`
+	MinTempo            float64 `json:"min_tempo,omitempty"`
+	MaxTempo            float64 `json:"max_tempo,omitempty"`
+	MinEnergy           float64 `json:"min_energy,omitempty"`
+	MaxEnergy           float64 `json:"max_energy,omitempty"`
+	MinDanceability     float64 `json:"min_danceability,omitempty"`
+	MaxDanceability     float64 `json:"max_danceability,omitempty"`
+	MinValence          float64 `json:"min_valence,omitempty"`
+	MaxValence          float64 `json:"max_valence,omitempty"`
+	MinAcousticness     float64 `json:"min_acousticness,omitempty"`
+	MaxAcousticness     float64 `json:"max_acousticness,omitempty"`
+	MinInstrumentalness float64 `json:"min_instrumentalness,omitempty"`
+	MaxInstrumentalness float64 `json:"max_instrumentalness,omitempty"`
+}
+
+// featureRange is the range one of the audio features is filtered
+// to.
+type featureRange struct {
+	name  string
+	min   float64
+	max   float64
+	limit float64
+	value func(spotify.AudioFeatures) float64
+}
+
+// active reports whether the range filters anything.
+func (r featureRange) active() bool {
+	return r.min != 0 || r.max != 0
+}
+
+// featureRanges lists the ranges for each of the audio features.
+func (filters Filters) featureRanges() []featureRange {
+	return []featureRange{
+		{
+			"tempo",
+			filters.MinTempo,
+			filters.MaxTempo,
+			MaxTempo,
+			func(f spotify.AudioFeatures) float64 { return f.Tempo },
+		},
+		{
+			"energy",
+			filters.MinEnergy,
+			filters.MaxEnergy,
+			1,
+			func(f spotify.AudioFeatures) float64 { return f.Energy },
+		},
+		{
+			"danceability",
+			filters.MinDanceability,
+			filters.MaxDanceability,
+			1,
+			func(f spotify.AudioFeatures) float64 { return f.Danceability },
+		},
+		{
+			"valence",
+			filters.MinValence,
+			filters.MaxValence,
+			1,
+			func(f spotify.AudioFeatures) float64 { return f.Valence },
+		},
+		{
+			"acousticness",
+			filters.MinAcousticness,
+			filters.MaxAcousticness,
+			1,
+			func(f spotify.AudioFeatures) float64 { return f.Acousticness },
+		},
+		{
+			"instrumentalness",
+			filters.MinInstrumentalness,
+			filters.MaxInstrumentalness,
+			1,
+			func(f spotify.AudioFeatures) float64 {
+				return f.Instrumentalness
+			},
+		},
+	}
+}
+
+// Active reports whether any of the filters are set.
+func (filters Filters) Active() bool {
+	return filters != Filters{}
+}
+
+// UsesAudioFeatures reports whether any of the audio feature ranges
+// are set, in which case the tracks' audio features have to be
+// fetched to filter them.
+func (filters Filters) UsesAudioFeatures() bool {
+	for _, r := range filters.featureRanges() {
+		if r.active() {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether track passes every filter.  features holds
+// the audio features of the tracks, keyed by ID, and is only looked
+// at if UsesAudioFeatures.
+func (filters Filters) Matches(
+	track spotify.Track,
+	features map[string]spotify.AudioFeatures,
+) bool {
+	if filters.ExcludeExplicit && track.Explicit {
+		return false
+	}
+
+	if filters.MinYear != 0 || filters.MaxYear != 0 {
+		year := track.ReleaseYear()
+		if year == 0 || !inRange(year, filters.MinYear, filters.MaxYear) {
+			return false
+		}
+	}
+
+	if !inRange(
+		track.Popularity,
+		filters.MinPopularity,
+		filters.MaxPopularity,
+	) {
+		return false
+	}
+
+	// Compare in milliseconds, so a track even a fraction of a second
+	// over the maximum doesn't match.
+	if !inRange(
+		track.DurationMS,
+		filters.MinDuration*1000,
+		filters.MaxDuration*1000,
+	) {
+		return false
+	}
+
+	for _, r := range filters.featureRanges() {
+		if !r.active() {
+			continue
+		}
+		trackFeatures, ok := features[track.ID]
+		if !ok || !inRange(r.value(trackFeatures), r.min, r.max) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange reports whether value is between min and max, either of
+// which is ignored if it's zero.
+func inRange[T int | float64](value T, min T, max T) bool {
+	return (min == 0 || value >= min) && (max == 0 || value <= max)
+}
+
+// fetchAudioFeatures fetches the audio features of every track in the
+// sources.
+func fetchAudioFeatures(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	sourceTracks [][]spotify.Track,
+) (map[string]spotify.AudioFeatures, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "fetch audio features")
+	defer span.End()
+
+	ids := []string{}
+	for _, id := range trackIDs(sourceTracks) {
+		ids = append(ids, id...)
+	}
+	features, err := spotify.GetAudioFeatures(ctx, authTokens, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("mixer.tracks", len(features)))
+	context.Logger(ctx).Info(
+		"fetched audio features",
+		"tracks", len(features),
+	)
+	return features, nil
+}
+
+// apply drops the tracks that don't match from each source, returning
+// what's left along with the number of tracks dropped.
+func (filters Filters) apply(
+	sourceTracks [][]spotify.Track,
+	features map[string]spotify.AudioFeatures,
+) ([][]spotify.Track, int) {
+	filtered := 0
+	kept := [][]spotify.Track{}
+	for _, tracks := range sourceTracks {
+		keptTracks := []spotify.Track{}
+		for _, track := range tracks {
+			if !filters.Matches(track, features) {
+				filtered++
+				continue
+			}
+			keptTracks = append(keptTracks, track)
+		}
+		kept = append(kept, keptTracks)
+	}
+	return kept, filtered
+}
+
+// validate checks that each range is in bounds and the right way
+// round.
+func (filters Filters) validate() []FieldError {
+	problems := []FieldError{}
+	problems = append(
+		problems,
+		validateRange("year", filters.MinYear, filters.MaxYear, 9999)...,
+	)
+	problems = append(
+		problems,
+		validateRange(
+			"popularity",
+			filters.MinPopularity,
+			filters.MaxPopularity,
+			MaxPopularity,
+		)...,
+	)
+	// Nothing on Spotify comes anywhere near a day long.
+	problems = append(
+		problems,
+		validateRange(
+			"duration",
+			filters.MinDuration,
+			filters.MaxDuration,
+			24*60*60,
+		)...,
+	)
+	for _, r := range filters.featureRanges() {
+		problems = append(
+			problems,
+			validateRange(r.name, r.min, r.max, r.limit)...,
+		)
+	}
+	return problems
+}
+
+// validateRange checks that one of the filter ranges is between 0
+// and limit, with the minimum no greater than the maximum.
+func validateRange[T int | float64](
+	name string,
+	min T,
+	max T,
+	limit T,
+) []FieldError {
+	field := "options.filters."
+	switch {
+	case min < 0 || min > limit:
+		return []FieldError{{
+			Field:   field + "min_" + name,
+			Message: fmt.Sprintf("Must be between 0 and %v", limit),
+		}}
+	case max < 0 || max > limit:
+		return []FieldError{{
+			Field:   field + "max_" + name,
+			Message: fmt.Sprintf("Must be between 0 and %v", limit),
+		}}
+	case min != 0 && max != 0 && min > max:
+		return []FieldError{{
+			Field:   field + "max_" + name,
+			Message: "Can't be less than the minimum",
+		}}
+	}
+	return nil
+}
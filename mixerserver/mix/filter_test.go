@@ -0,0 +1,189 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	track := spotify.Track{
+		ID:         "a",
+		Explicit:   true,
+		Popularity: 50,
+		DurationMS: 180500,
+		Album:      spotify.Album{ReleaseDate: "1999-06"},
+	}
+	features := map[string]spotify.AudioFeatures{
+		"a": {Tempo: 120, Energy: 0.5},
+	}
+
+	tests := []struct {
+		name    string
+		track   spotify.Track
+		filters Filters
+		want    bool
+	}{
+		{"no filters", track, Filters{}, true},
+		{"explicit", track, Filters{ExcludeExplicit: true}, false},
+		{"year inside", track, Filters{MinYear: 1990, MaxYear: 2000}, true},
+		{"year at bounds", track, Filters{MinYear: 1999, MaxYear: 1999}, true},
+		{"year before", track, Filters{MinYear: 2000}, false},
+		{"year after", track, Filters{MaxYear: 1998}, false},
+		{
+			"year only",
+			spotify.Track{Album: spotify.Album{ReleaseDate: "1999"}},
+			Filters{MinYear: 1999, MaxYear: 1999},
+			true,
+		},
+		{
+			"full date",
+			spotify.Track{Album: spotify.Album{ReleaseDate: "1999-12-31"}},
+			Filters{MaxYear: 1999},
+			true,
+		},
+		{
+			"no release date",
+			spotify.Track{},
+			Filters{MaxYear: 2000},
+			false,
+		},
+		{"no release date unfiltered", spotify.Track{}, Filters{}, true},
+		{
+			"popularity at bounds",
+			track,
+			Filters{MinPopularity: 50, MaxPopularity: 50},
+			true,
+		},
+		{"popularity below", track, Filters{MinPopularity: 51}, false},
+		{
+			"duration inside",
+			track,
+			Filters{MinDuration: 180, MaxDuration: 181},
+			true,
+		},
+		{"duration at minimum", track, Filters{MinDuration: 180}, true},
+		{"duration just over maximum", track, Filters{MaxDuration: 180}, false},
+		{"duration too short", track, Filters{MinDuration: 181}, false},
+		{"tempo at bounds", track, Filters{MinTempo: 120, MaxTempo: 120}, true},
+		{"tempo too slow", track, Filters{MinTempo: 121}, false},
+		{"energy inside", track, Filters{MinEnergy: 0.4, MaxEnergy: 0.6}, true},
+		{"energy too high", track, Filters{MaxEnergy: 0.4}, false},
+		{
+			"no audio features",
+			spotify.Track{ID: "b"},
+			Filters{MinEnergy: 0.1},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.filters.Matches(test.track, features)
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		value, min, max int
+		want            bool
+	}{
+		{5, 0, 0, true},
+		{5, 5, 5, true},
+		{5, 6, 0, false},
+		{5, 0, 4, false},
+		{5, 1, 0, true},
+		{5, 0, 9, true},
+		{0, 0, 9, true},
+	}
+
+	for _, test := range tests {
+		got := inRange(test.value, test.min, test.max)
+		if got != test.want {
+			t.Errorf(
+				"inRange(%d, %d, %d) = %v, want %v",
+				test.value,
+				test.min,
+				test.max,
+				got,
+				test.want,
+			)
+		}
+	}
+
+	if !inRange(0.5, 0.5, 0.5) || inRange(0.51, 0, 0.5) {
+		t.Error("float bounds aren't inclusive")
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		want    string
+	}{
+		{"unset", Filters{}, "[]"},
+		{"equal bounds", Filters{MinYear: 1999, MaxYear: 1999}, "[]"},
+		{"only maximum", Filters{MaxPopularity: 10}, "[]"},
+		{
+			"minimum over maximum",
+			Filters{MinYear: 2000, MaxYear: 1999},
+			"[options.filters.max_year: Can't be less than the minimum]",
+		},
+		{
+			"float minimum over maximum",
+			Filters{MinEnergy: 0.6, MaxEnergy: 0.5},
+			"[options.filters.max_energy: Can't be less than the minimum]",
+		},
+		{
+			"negative",
+			Filters{MinDuration: -1},
+			"[options.filters.min_duration: Must be between 0 and 86400]",
+		},
+		{
+			"over the limit",
+			Filters{MaxPopularity: 101},
+			"[options.filters.max_popularity: Must be between 0 and 100]",
+		},
+		{
+			"feature over the limit",
+			Filters{MaxValence: 1.5},
+			"[options.filters.max_valence: Must be between 0 and 1]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, problem := range test.filters.validate() {
+				got = append(got, problem.Field+": "+problem.Message)
+			}
+			if fmt.Sprint(got) != test.want {
+				t.Errorf("got %v, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/metrics"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"time"
+)
+
+// Outcome classifies the error a mix finished with as one of the
+// metrics.Outcome* values.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return metrics.OutcomeSucceeded
+	case errors.Is(err, gocontext.Canceled):
+		return metrics.OutcomeCancelled
+	default:
+		return metrics.OutcomeFailed
+	}
+}
+
+// RunJob runs a mix as a background job, wrapping Run with the
+// logging, tracing and metrics every job gets.  ctx should be a job
+// context created by context.Detach.  Since nothing above a job
+// recovers panics, RunJob turns them into errors rather than let a
+// bug take the whole server down.  sourceTrackIDs is passed on to Run.
+func RunJob(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	request Request,
+	sourceTrackIDs [][]string,
+) (result Result, err error) {
+	t0 := time.Now()
+	log := context.Logger(ctx)
+
+	ctx, span := tracing.Tracer.Start(ctx, "mix")
+	span.SetAttributes(
+		attribute.String("mixer.job_id", context.JobID(ctx)),
+		attribute.StringSlice("mixer.sources", request.SourceIDs()),
+		attribute.String("mixer.destination", request.DestList.ID),
+	)
+	defer span.End()
+
+	metrics.JobsRunning.Inc()
+	defer metrics.JobsRunning.Dec()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("mix panicked: %v", recovered)
+		}
+
+		outcome := Outcome(err)
+		metrics.JobsFinished.WithLabelValues(outcome).Inc()
+		switch outcome {
+		case metrics.OutcomeSucceeded:
+			metrics.TracksWritten.Add(float64(len(result.TrackIDs)))
+			log.Info(
+				"mix finished",
+				"tracks", len(result.TrackIDs),
+				"excluded", result.Excluded,
+				"filtered", result.Filtered,
+				"duration", time.Now().Sub(t0),
+			)
+		case metrics.OutcomeCancelled:
+			span.SetStatus(codes.Error, "cancelled")
+			log.Warn("mix cancelled before writing", "error", err)
+		default:
+			span.SetStatus(codes.Error, err.Error())
+			log.Error("mix failed", "error", err)
+		}
+	}()
+
+	if request.Options.Seed == 0 {
+		request.Options.Seed = NewSeed()
+	}
+	log.Info(
+		"mix started",
+		"sources", request.SourceIDs(),
+		"destination", request.DestList.ID,
+		"exclude_lists", request.ExcludeIDs(),
+		"round_robin", request.Options.RoundRobin,
+		"shuffle", request.Options.Shuffle,
+		"dedup", request.Options.Dedup,
+		"pad", request.Options.Pad,
+		"exclude_artists", request.Options.ExcludeArtists,
+		"filters", request.Options.Filters,
+		"seed", request.Options.Seed,
+		"from_snapshot", sourceTrackIDs != nil,
+	)
+
+	return Run(ctx, authTokens, request, sourceTrackIDs)
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package mix implements the playlist mixing pipeline shared by the
+// web server's background jobs and the command line: fetching the
+// source playlists, combining their tracks and writing the result to
+// the destination playlist.
+package mix
+
+import (
+	gocontext "context"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"math/rand"
+)
+
+// ErrNoTracks is returned by Run when the request's exclusions and
+// filters leave nothing to mix, rather than empty the destination.
+var ErrNoTracks = errors.New("No tracks left after exclusions and filters")
+
+// List identifies a playlist along with the user who owns it.
+// Weight only applies to source playlists mixed round robin, and sets
+// how many tracks to take from the playlist on each of its turns.
+// Zero is treated as one.
+type List struct {
+	ID      string `json:"id"`
+	OwnerID string `json:"owner_id"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+// Options controls how the source playlists are combined.  Seed seeds
+// the shuffle, so a mix run again with the same seed and sources comes
+// out the same.  Zero means pick a new one.  ExcludeArtists widens
+// the request's exclusion playlists to every track by any of the
+// artists on them.
+type Options struct {
+	RoundRobin     bool    `json:"round_robin"`
+	Shuffle        bool    `json:"shuffle"`
+	Dedup          bool    `json:"dedup"`
+	Pad            bool    `json:"pad"`
+	Seed           int64   `json:"seed,omitempty"`
+	ExcludeArtists bool    `json:"exclude_artists"`
+	Filters        Filters `json:"filters"`
+}
+
+// Request describes a single mix: where the tracks come from, where
+// they go, and how they're combined.  Tracks on any of the exclusion
+// playlists are left out of the sources before they're combined.
+type Request struct {
+	SourceLists  []List  `json:"source_lists"`
+	ExcludeLists []List  `json:"exclude_lists,omitempty"`
+	DestList     List    `json:"dest_list"`
+	Options      Options `json:"options"`
+}
+
+// SourceIDs returns the IDs of the request's source playlists.
+func (request Request) SourceIDs() []string {
+	ids := []string{}
+	for _, list := range request.SourceLists {
+		ids = append(ids, list.ID)
+	}
+	return ids
+}
+
+// ExcludeIDs returns the IDs of the request's exclusion playlists.
+func (request Request) ExcludeIDs() []string {
+	ids := []string{}
+	for _, list := range request.ExcludeLists {
+		ids = append(ids, list.ID)
+	}
+	return ids
+}
+
+// Weights returns the weight of each of the request's source
+// playlists.
+func (request Request) Weights() []int {
+	weights := []int{}
+	for _, list := range request.SourceLists {
+		weights = append(weights, list.Weight)
+	}
+	return weights
+}
+
+// Result reports what a successful mix wrote, along with the seed it
+// used, the tracks it mixed from each source and the number of source
+// tracks that were excluded or filtered out.
+type Result struct {
+	Seed           int64
+	SourceTrackIDs [][]string
+	Excluded       int
+	Filtered       int
+	TrackIDs       []string
+}
+
+// MaxSeed is the largest seed a mix accepts.  Seeds are kept to what
+// JavaScript numbers can hold exactly, so they survive a round trip
+// through the browser.
+const MaxSeed = 1<<53 - 1
+
+// NewSeed picks a new random seed for a mix.
+func NewSeed() int64 {
+	return rand.Int63n(MaxSeed) + 1
+}
+
+// Run fetches the source playlists, combines them and overwrites the
+// destination playlist with the result.  The request should already
+// have been validated.  Progress is logged to the logger on ctx.
+//
+// If sourceTrackIDs isn't nil, it's mixed in place of the sources'
+// current tracks, to repeat an earlier mix exactly.  They should be
+// the tracks left after any exclusions and filters, as they're mixed
+// as is.  If the request has no seed, a new one is picked.  If the
+// exclusions and filters leave no tracks, the destination playlist is
+// left alone and ErrNoTracks returned.
+//
+// If ctx is cancelled before we start writing to the destination
+// playlist the mix is abandoned and ctx's error returned, but once
+// writing has started it runs to completion so we never leave the
+// playlist half written.
+func Run(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	request Request,
+	sourceTrackIDs [][]string,
+) (Result, error) {
+	log := context.Logger(ctx)
+
+	if request.Options.Seed == 0 {
+		request.Options.Seed = NewSeed()
+	}
+
+	excluded, filtered := 0, 0
+	if sourceTrackIDs == nil {
+		sourceTracks, err := fetchSources(ctx, authTokens, request)
+		if err != nil {
+			return Result{}, err
+		}
+
+		if len(request.ExcludeLists) != 0 {
+			excluder, err := fetchExclusions(ctx, authTokens, request)
+			if err != nil {
+				return Result{}, err
+			}
+			sourceTracks, excluded = excluder.apply(sourceTracks)
+			log.Info("excluded tracks", "tracks", excluded)
+		}
+
+		filters := request.Options.Filters
+		if filters.Active() {
+			var features map[string]spotify.AudioFeatures
+			if filters.UsesAudioFeatures() {
+				features, err = fetchAudioFeatures(
+					ctx,
+					authTokens,
+					sourceTracks,
+				)
+				if err != nil {
+					return Result{}, err
+				}
+			}
+			sourceTracks, filtered = filters.apply(sourceTracks, features)
+			log.Info("filtered tracks", "tracks", filtered)
+		}
+
+		sourceTrackIDs = trackIDs(sourceTracks)
+	}
+
+	_, combineSpan := tracing.Tracer.Start(ctx, "combine")
+	combinedTrackIDs := Combine(
+		sourceTrackIDs,
+		request.Weights(),
+		request.Options,
+	)
+	combineSpan.SetAttributes(
+		attribute.Int("mixer.tracks", len(combinedTrackIDs)),
+	)
+	combineSpan.End()
+	log.Info("combined source playlists", "tracks", len(combinedTrackIDs))
+	if len(combinedTrackIDs) == 0 && excluded+filtered > 0 {
+		return Result{}, ErrNoTracks
+	}
+
+	// This is the last safe point to stop at.  From here on we ignore
+	// cancellation, since stopping partway through would leave the
+	// destination playlist half empty.
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	writeCtx, writeSpan := tracing.Tracer.Start(
+		gocontext.WithoutCancel(ctx),
+		"write playlist",
+	)
+	err := spotify.WritePlaylist(
+		writeCtx,
+		authTokens,
+		request.DestList.OwnerID,
+		request.DestList.ID,
+		combinedTrackIDs,
+	)
+	writeSpan.End()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Seed:           request.Options.Seed,
+		SourceTrackIDs: sourceTrackIDs,
+		Excluded:       excluded,
+		Filtered:       filtered,
+		TrackIDs:       combinedTrackIDs,
+	}, nil
+}
+
+// fetchSources fetches the tracks of each of the request's source
+// playlists.
+func fetchSources(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	request Request,
+) ([][]spotify.Track, error) {
+	log := context.Logger(ctx)
+
+	ctx, span := tracing.Tracer.Start(ctx, "fetch sources")
+	defer span.End()
+
+	sourceTracks := [][]spotify.Track{}
+	for i, list := range request.SourceLists {
+		tracks, err := spotify.GetPlaylistTracks(
+			ctx,
+			authTokens,
+			list.OwnerID,
+			list.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info(
+			"fetched source playlist",
+			"playlist", list.ID,
+			"tracks", len(tracks),
+			"progress", i+1,
+			"total", len(request.SourceLists),
+		)
+		sourceTracks = append(sourceTracks, tracks)
+	}
+	return sourceTracks, nil
+}
+
+// trackIDs returns the IDs of each source's tracks.
+func trackIDs(sourceTracks [][]spotify.Track) [][]string {
+	sourceTrackIDs := [][]string{}
+	for _, tracks := range sourceTracks {
+		ids := []string{}
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+		sourceTrackIDs = append(sourceTrackIDs, ids)
+	}
+	return sourceTrackIDs
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakePlaylists stands in for the Spotify API, serving the tracks of
+// the playlists in sources and recording what's written to or cleared
+// from any playlist.
+type fakePlaylists struct {
+	t       *testing.T
+	sources map[string][]string
+	fetched []string
+	written []string
+	cleared bool
+}
+
+func (f *fakePlaylists) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Paths look like /v1/users/<owner>/playlists/<id>/tracks.
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 7 || parts[6] != "tracks" {
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := parts[5]
+
+	switch r.Method {
+	case "GET":
+		items := []map[string]spotify.Track{}
+		if tracks, ok := f.sources[id]; ok {
+			f.fetched = append(f.fetched, id)
+			for _, track := range tracks {
+				items = append(
+					items,
+					map[string]spotify.Track{"track": {ID: track}},
+				)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case "DELETE":
+		f.cleared = true
+	case "POST":
+		body := struct {
+			URIs []string `json:"uris"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			f.t.Error(err)
+		}
+		for _, uri := range body.URIs {
+			f.written = append(
+				f.written,
+				strings.TrimPrefix(uri, "spotify:track:"),
+			)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestRunFromSnapshot(t *testing.T) {
+	api := &fakePlaylists{
+		t: t,
+		sources: map[string][]string{
+			"first":  {"a", "b", "c", "d"},
+			"second": {"e", "f"},
+		},
+	}
+	t.Cleanup(spotify.StubAPI(api))
+
+	request := Request{
+		SourceLists: []List{
+			{ID: "first", OwnerID: "me", Weight: 2},
+			{ID: "second", OwnerID: "me"},
+		},
+		DestList: List{ID: "dest", OwnerID: "me"},
+		Options:  Options{RoundRobin: true, Shuffle: true, Pad: true},
+	}
+	tokens := spotify.AuthTokens{AccessToken: "token"}
+
+	first, err := Run(gocontext.Background(), tokens, request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(api.fetched) != "[first second]" {
+		t.Fatalf("fetched sources %v, want [first second]", api.fetched)
+	}
+	if fmt.Sprint(api.written) != fmt.Sprint(first.TrackIDs) {
+		t.Fatalf("wrote %v, want %v", api.written, first.TrackIDs)
+	}
+
+	// The sources change, but the rerun should mix what was
+	// snapshotted without looking at them.
+	api.sources["first"] = []string{"x"}
+	api.fetched = nil
+	api.written = nil
+	request.Options.Seed = first.Seed
+
+	second, err := Run(
+		gocontext.Background(),
+		tokens,
+		request,
+		first.SourceTrackIDs,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.fetched) != 0 {
+		t.Errorf("rerun fetched sources %v", api.fetched)
+	}
+	if fmt.Sprint(second.TrackIDs) != fmt.Sprint(first.TrackIDs) {
+		t.Errorf("rerun mixed %v, want %v", second.TrackIDs, first.TrackIDs)
+	}
+	if fmt.Sprint(api.written) != fmt.Sprint(first.TrackIDs) {
+		t.Errorf("rerun wrote %v, want %v", api.written, first.TrackIDs)
+	}
+}
+
+func TestRunKeepsDestinationWhenNothingIsLeft(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []List
+		options Options
+	}{
+		{
+			name:    "excluded",
+			exclude: []List{{ID: "exclude", OwnerID: "me"}},
+		},
+		{
+			name:    "filtered",
+			options: Options{Filters: Filters{MinPopularity: 50}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakePlaylists{
+				t: t,
+				sources: map[string][]string{
+					"source":  {"a", "b"},
+					"exclude": {"a", "b"},
+					"dest":    {"z"},
+				},
+			}
+			t.Cleanup(spotify.StubAPI(api))
+
+			request := Request{
+				SourceLists:  []List{{ID: "source", OwnerID: "me"}},
+				ExcludeLists: test.exclude,
+				DestList:     List{ID: "dest", OwnerID: "me"},
+				Options:      test.options,
+			}
+			_, err := Run(
+				gocontext.Background(),
+				spotify.AuthTokens{AccessToken: "token"},
+				request,
+				nil,
+			)
+			if !errors.Is(err, ErrNoTracks) {
+				t.Errorf("Run = %v, want ErrNoTracks", err)
+			}
+			if api.cleared || len(api.written) != 0 {
+				t.Errorf(
+					"destination cleared %v and written %v",
+					api.cleared,
+					api.written,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mix
+
+import (
+	gocontext "context"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"regexp"
+)
+
+// FieldError describes a problem with a single field of a request.
+// Field is the path to the field in the request's JSON, like
+// "source_lists[2].id".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// MaxSourceLists caps the number of playlists a single mix can draw
+// from.
+const MaxSourceLists = 50
+
+// MaxExcludeLists caps the number of playlists a single mix can
+// exclude tracks from.
+const MaxExcludeLists = 20
+
+// MaxWeight caps the weight of a single source playlist.
+const MaxWeight = 100
+
+// Spotify playlist IDs are always 22 base62 characters.  User IDs are
+// less regular, but we splice them into API paths, so at least make
+// sure they can't escape their path segment.
+var playlistIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+var userIDPattern = regexp.MustCompile(`^[^/?#%\s]{1,128}$`)
+
+// IsPlaylistID reports whether id looks like a Spotify playlist ID.
+func IsPlaylistID(id string) bool {
+	return playlistIDPattern.MatchString(id)
+}
+
+// validateList checks the IDs of a single playlist reference.
+func validateList(field string, list List) []FieldError {
+	problems := []FieldError{}
+	if !IsPlaylistID(list.ID) {
+		problems = append(problems, FieldError{
+			Field:   field + ".id",
+			Message: "Not a valid playlist ID",
+		})
+	}
+	if !userIDPattern.MatchString(list.OwnerID) {
+		problems = append(problems, FieldError{
+			Field:   field + ".owner_id",
+			Message: "Not a valid user ID",
+		})
+	}
+	return problems
+}
+
+// Validate checks a request for problems that can be spotted
+// without calling the API, and returns every one it finds.
+func (request Request) Validate() []FieldError {
+	problems := []FieldError{}
+
+	switch {
+	case len(request.SourceLists) == 0:
+		problems = append(problems, FieldError{
+			Field:   "source_lists",
+			Message: "At least one source playlist is required",
+		})
+	case len(request.SourceLists) > MaxSourceLists:
+		problems = append(problems, FieldError{
+			Field: "source_lists",
+			Message: fmt.Sprintf(
+				"No more than %d source playlists are allowed",
+				MaxSourceLists,
+			),
+		})
+	}
+
+	seenIDs := map[string]bool{}
+	for i, list := range request.SourceLists {
+		field := fmt.Sprintf("source_lists[%d]", i)
+		problems = append(problems, validateList(field, list)...)
+
+		if seenIDs[list.ID] {
+			problems = append(problems, FieldError{
+				Field:   field + ".id",
+				Message: "Playlist is listed more than once",
+			})
+		}
+		seenIDs[list.ID] = true
+
+		switch {
+		case list.Weight < 0 || list.Weight > MaxWeight:
+			problems = append(problems, FieldError{
+				Field: field + ".weight",
+				Message: fmt.Sprintf(
+					"Weight must be between 1 and %d",
+					MaxWeight,
+				),
+			})
+		case list.Weight > 1 && !request.Options.RoundRobin:
+			problems = append(problems, FieldError{
+				Field:   field + ".weight",
+				Message: "Weights only apply when mixing round robin",
+			})
+		}
+	}
+
+	problems = append(problems, validateList("dest_list", request.DestList)...)
+	if seenIDs[request.DestList.ID] {
+		problems = append(problems, FieldError{
+			Field:   "dest_list.id",
+			Message: "The destination can't also be a source",
+		})
+	}
+
+	if len(request.ExcludeLists) > MaxExcludeLists {
+		problems = append(problems, FieldError{
+			Field: "exclude_lists",
+			Message: fmt.Sprintf(
+				"No more than %d exclusion playlists are allowed",
+				MaxExcludeLists,
+			),
+		})
+	}
+	excludedIDs := map[string]bool{}
+	for i, list := range request.ExcludeLists {
+		field := fmt.Sprintf("exclude_lists[%d]", i)
+		problems = append(problems, validateList(field, list)...)
+
+		switch {
+		case seenIDs[list.ID]:
+			problems = append(problems, FieldError{
+				Field:   field + ".id",
+				Message: "A source can't also be excluded",
+			})
+		case excludedIDs[list.ID]:
+			problems = append(problems, FieldError{
+				Field:   field + ".id",
+				Message: "Playlist is listed more than once",
+			})
+		}
+		excludedIDs[list.ID] = true
+
+		if list.Weight != 0 {
+			problems = append(problems, FieldError{
+				Field:   field + ".weight",
+				Message: "Only source playlists can have a weight",
+			})
+		}
+	}
+	if request.Options.ExcludeArtists && len(request.ExcludeLists) == 0 {
+		problems = append(problems, FieldError{
+			Field:   "options.exclude_artists",
+			Message: "Excluding artists needs at least one exclusion playlist",
+		})
+	}
+
+	problems = append(problems, request.Options.Filters.validate()...)
+
+	if request.Options.Seed < 0 || request.Options.Seed > MaxSeed {
+		problems = append(problems, FieldError{
+			Field:   "options.seed",
+			Message: fmt.Sprintf("Must be between 0 and %d", MaxSeed),
+		})
+	}
+
+	return problems
+}
+
+// ValidateOwnership makes sure the user is allowed to overwrite the
+// destination playlist, and that it's owned by who the request says
+// it is.
+func (request Request) ValidateOwnership(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	userID string,
+) ([]FieldError, error) {
+	problems := []FieldError{}
+
+	destList, err := spotify.GetPlaylist(ctx, authTokens, request.DestList.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if destList.Owner.ID != request.DestList.OwnerID {
+		problems = append(problems, FieldError{
+			Field:   "dest_list.owner_id",
+			Message: "Doesn't match the playlist's owner",
+		})
+	}
+	if destList.Owner.ID != userID && !destList.Collaborative {
+		problems = append(problems, FieldError{
+			Field:   "dest_list.id",
+			Message: "You can only write to your own or collaborative playlists",
+		})
+	}
+
+	return problems, nil
+}
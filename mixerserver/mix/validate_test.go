@@ -0,0 +1,90 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mix
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testList makes a valid playlist reference with an ID built from n.
+func testList(n int) List {
+	id := fmt.Sprintf("list%d", n)
+	return List{
+		ID:      id + strings.Repeat("x", 22-len(id)),
+		OwnerID: "owner",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Request
+		fields  []string
+	}{
+		{
+			name: "single source with round robin and pad",
+			request: Request{
+				SourceLists: []List{testList(1)},
+				DestList:    testList(2),
+				Options:     Options{RoundRobin: true, Pad: true},
+			},
+		},
+		{
+			name: "no sources",
+			request: Request{
+				DestList: testList(2),
+			},
+			fields: []string{"source_lists"},
+		},
+		{
+			name: "bad IDs",
+			request: Request{
+				SourceLists: []List{{ID: "short", OwnerID: "a/b"}},
+				DestList:    testList(2),
+			},
+			fields: []string{
+				"source_lists[0].id",
+				"source_lists[0].owner_id",
+			},
+		},
+		{
+			name: "seed out of range",
+			request: Request{
+				SourceLists: []List{testList(1)},
+				DestList:    testList(2),
+				Options:     Options{Seed: MaxSeed + 1},
+			},
+			fields: []string{"options.seed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := []string{}
+			for _, problem := range test.request.Validate() {
+				fields = append(fields, problem.Field)
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(test.fields) {
+				t.Errorf("problems with %v, want %v", fields, test.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/config"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/recipe"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// newMixCommand creates the mix command, which runs a single mix
+// without the web server, authenticating with a refresh token.
+func newMixCommand() *cobra.Command {
+	var recipePath string
+	var sourceIDs []string
+	var excludeIDs []string
+	var destID string
+	var options recipe.Options
+
+	command := &cobra.Command{
+		Use:   "mix {--recipe FILE | --source ID... --dest ID}",
+		Short: "Mix playlists from the command line",
+		Long: `Mix the source playlists into the destination playlist, exactly
+as submitting the web form would, and wait for the mix to finish.
+The mix can be described with flags or by a recipe file, in which
+case any option flags given override the recipe's options.
+
+This authenticates with the credentials saved by the login command,
+or with spotify_refresh_token if that's set, instead of a browser
+login, so it can run from cron or CI.  Progress is logged to stderr,
+and the command exits non-zero if the mix fails.`,
+		Args:    cobra.NoArgs,
+		PreRunE: bindConfigFlags,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags := cmd.Flags()
+			mixRecipe := recipe.Recipe{}
+
+			if recipePath != "" {
+				if flags.Changed("source") ||
+					flags.Changed("exclude") ||
+					flags.Changed("dest") {
+					return errors.New(
+						"--source, --exclude and --dest can't be used " +
+							"with --recipe",
+					)
+				}
+
+				var err error
+				mixRecipe, err = recipe.Load(recipePath)
+				if err != nil {
+					return err
+				}
+			} else {
+				if len(sourceIDs) == 0 || destID == "" {
+					return errors.New(
+						"either --recipe or --source and --dest are required",
+					)
+				}
+
+				for _, id := range sourceIDs {
+					mixRecipe.Sources = append(
+						mixRecipe.Sources,
+						recipe.Playlist{ID: id},
+					)
+				}
+				for _, id := range excludeIDs {
+					mixRecipe.Exclude = append(
+						mixRecipe.Exclude,
+						recipe.Playlist{ID: id},
+					)
+				}
+				mixRecipe.Destination = recipe.Playlist{ID: destID}
+			}
+
+			if flags.Changed("round-robin") {
+				mixRecipe.Options.RoundRobin = options.RoundRobin
+			}
+			if flags.Changed("shuffle") {
+				mixRecipe.Options.Shuffle = options.Shuffle
+			}
+			if flags.Changed("dedup") {
+				mixRecipe.Options.Dedup = options.Dedup
+			}
+			if flags.Changed("pad") {
+				mixRecipe.Options.Pad = options.Pad
+			}
+			if flags.Changed("seed") {
+				mixRecipe.Options.Seed = options.Seed
+			}
+			if flags.Changed("exclude-artists") {
+				mixRecipe.Options.ExcludeArtists = options.ExcludeArtists
+			}
+			overrideFilters(
+				flags,
+				&mixRecipe.Options.Filters,
+				options.Filters,
+			)
+
+			return runMix(mixRecipe)
+		},
+	}
+
+	flags := command.Flags()
+	flags.StringVar(
+		&recipePath,
+		"recipe",
+		"",
+		"recipe file describing the mix (YAML, TOML or JSON)",
+	)
+	flags.StringSliceVar(
+		&sourceIDs,
+		"source",
+		nil,
+		"source playlist ID (repeat or comma-separate for several)",
+	)
+	flags.StringSliceVar(
+		&excludeIDs,
+		"exclude",
+		nil,
+		"playlist ID whose tracks to leave out (repeat for several)",
+	)
+	flags.StringVar(&destID, "dest", "", "destination playlist ID")
+	flags.BoolVar(
+		&options.RoundRobin,
+		"round-robin",
+		false,
+		"take tracks from each source in turn",
+	)
+	flags.BoolVar(&options.Shuffle, "shuffle", false, "shuffle each source")
+	flags.BoolVar(&options.Dedup, "dedup", false, "drop duplicate tracks")
+	flags.BoolVar(
+		&options.Pad,
+		"pad",
+		false,
+		"repeat shorter sources to match the longest",
+	)
+	flags.BoolVar(
+		&options.ExcludeArtists,
+		"exclude-artists",
+		false,
+		"also leave out every track by the excluded tracks' artists",
+	)
+	flags.Int64Var(
+		&options.Seed,
+		"seed",
+		0,
+		"seed for the shuffle, to repeat an earlier mix (0 picks one)",
+	)
+	addFilterFlags(flags, &options.Filters)
+	config.AddClientFlags(flags)
+
+	return command
+}
+
+// intFilterFlags lists the filter flags that take a number, along with
+// where to find each one's value in a set of filters.
+var intFilterFlags = []struct {
+	name  string
+	usage string
+	field func(*recipe.Filters) *int
+}{
+	{
+		"min-year",
+		"leave out tracks released before this year",
+		func(f *recipe.Filters) *int { return &f.MinYear },
+	},
+	{
+		"max-year",
+		"leave out tracks released after this year",
+		func(f *recipe.Filters) *int { return &f.MaxYear },
+	},
+	{
+		"min-popularity",
+		"leave out tracks less popular than this (0-100)",
+		func(f *recipe.Filters) *int { return &f.MinPopularity },
+	},
+	{
+		"max-popularity",
+		"leave out tracks more popular than this (0-100)",
+		func(f *recipe.Filters) *int { return &f.MaxPopularity },
+	},
+	{
+		"min-duration",
+		"leave out tracks shorter than this many seconds",
+		func(f *recipe.Filters) *int { return &f.MinDuration },
+	},
+	{
+		"max-duration",
+		"leave out tracks longer than this many seconds",
+		func(f *recipe.Filters) *int { return &f.MaxDuration },
+	},
+}
+
+// floatFilterFlags lists the audio feature filter flags, along with
+// where to find each one's value in a set of filters.
+var floatFilterFlags = []struct {
+	name  string
+	usage string
+	field func(*recipe.Filters) *float64
+}{
+	{
+		"min-tempo",
+		"leave out tracks with a tempo slower than this many BPM",
+		func(f *recipe.Filters) *float64 { return &f.MinTempo },
+	},
+	{
+		"max-tempo",
+		"leave out tracks with a tempo faster than this many BPM",
+		func(f *recipe.Filters) *float64 { return &f.MaxTempo },
+	},
+	{
+		"min-energy",
+		"leave out tracks with energy lower than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MinEnergy },
+	},
+	{
+		"max-energy",
+		"leave out tracks with energy higher than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MaxEnergy },
+	},
+	{
+		"min-danceability",
+		"leave out tracks with danceability lower than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MinDanceability },
+	},
+	{
+		"max-danceability",
+		"leave out tracks with danceability higher than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MaxDanceability },
+	},
+	{
+		"min-valence",
+		"leave out tracks with valence lower than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MinValence },
+	},
+	{
+		"max-valence",
+		"leave out tracks with valence higher than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MaxValence },
+	},
+	{
+		"min-acousticness",
+		"leave out tracks with acousticness lower than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MinAcousticness },
+	},
+	{
+		"max-acousticness",
+		"leave out tracks with acousticness higher than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MaxAcousticness },
+	},
+	{
+		"min-instrumentalness",
+		"leave out tracks with instrumentalness lower than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MinInstrumentalness },
+	},
+	{
+		"max-instrumentalness",
+		"leave out tracks with instrumentalness higher than this (0-1)",
+		func(f *recipe.Filters) *float64 { return &f.MaxInstrumentalness },
+	},
+}
+
+// addFilterFlags adds a flag for each of the mix filters, storing
+// their values in filters.
+func addFilterFlags(flags *pflag.FlagSet, filters *recipe.Filters) {
+	flags.BoolVar(
+		&filters.ExcludeExplicit,
+		"exclude-explicit",
+		false,
+		"leave out explicit tracks",
+	)
+	for _, flag := range intFilterFlags {
+		flags.IntVar(flag.field(filters), flag.name, 0, flag.usage)
+	}
+	for _, flag := range floatFilterFlags {
+		flags.Float64Var(flag.field(filters), flag.name, 0, flag.usage)
+	}
+}
+
+// overrideFilters copies the filters given on the command line over
+// the recipe's.
+func overrideFilters(
+	flags *pflag.FlagSet,
+	recipeFilters *recipe.Filters,
+	flagFilters recipe.Filters,
+) {
+	if flags.Changed("exclude-explicit") {
+		recipeFilters.ExcludeExplicit = flagFilters.ExcludeExplicit
+	}
+	for _, flag := range intFilterFlags {
+		if flags.Changed(flag.name) {
+			*flag.field(recipeFilters) = *flag.field(&flagFilters)
+		}
+	}
+	for _, flag := range floatFilterFlags {
+		if flags.Changed(flag.name) {
+			*flag.field(recipeFilters) = *flag.field(&flagFilters)
+		}
+	}
+}
+
+// runMix authenticates, resolves and validates the recipe and runs
+// the mix.  Interrupting it before it starts writing abandons the mix.
+func runMix(mixRecipe recipe.Recipe) error {
+	// Catch any problems we can before bothering to authenticate.
+	if problems := mixRecipe.Validate(); len(problems) != 0 {
+		return invalidMix(problems)
+	}
+
+	ctx, stop := signal.NotifyContext(
+		gocontext.Background(),
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	ctx, err := loadClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+	log := context.Logger(ctx)
+
+	authTokens, err := clientAuthTokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	userID, err := spotify.GetUserID(ctx, authTokens)
+	if err != nil {
+		return err
+	}
+
+	request, problems, err := mixRecipe.Resolve(ctx, authTokens, userID)
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		return invalidMix(problems)
+	}
+
+	log.Info(
+		"mix started",
+		"sources", request.SourceIDs(),
+		"destination", request.DestList.ID,
+	)
+	result, err := mix.Run(ctx, authTokens, request, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"Wrote %d tracks to https://open.spotify.com/playlist/%s (seed %d)\n",
+		len(result.TrackIDs),
+		request.DestList.ID,
+		result.Seed,
+	)
+	if result.Excluded != 0 {
+		fmt.Printf("Excluded %d tracks\n", result.Excluded)
+	}
+	if result.Filtered != 0 {
+		fmt.Printf("Filtered out %d tracks\n", result.Filtered)
+	}
+	return nil
+}
+
+// invalidMix prints the problems found with a mix to stderr, and
+// returns an error to exit with.
+func invalidMix(problems []mix.FieldError) error {
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", problem.Field, problem.Message)
+	}
+	return fmt.Errorf("found %d problem(s) with the mix", len(problems))
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package recipe loads mix recipes: files describing a mix that gets
+// run over and over, so the same sources, destination and options
+// don't have to be picked out by hand every time.  Recipes can be
+// written in YAML, TOML or JSON, and can name playlists either by ID
+// or by name, for example
+//
+//	name: Monday Mix
+//	sources:
+//	  - name: Office Favourites
+//	    weight: 2
+//	  - id: 37i9dQZF1DXcBWIGoYBM5M
+//	destination:
+//	  name: Monday Mix
+//	options:
+//	  round_robin: true
+//	  shuffle: true
+package recipe
+
+import (
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/spf13/viper"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Formats lists the file formats a recipe can be written in.
+var Formats = []string{"yaml", "yml", "toml", "json"}
+
+// Playlist refers to a playlist by either its ID or its name.  Weight
+// is passed through to mix.List for source playlists.
+type Playlist struct {
+	ID     string `mapstructure:"id" json:"id,omitempty"`
+	Name   string `mapstructure:"name" json:"name,omitempty"`
+	Weight int    `mapstructure:"weight" json:"weight,omitempty"`
+}
+
+// Options mirrors mix.Options.
+type Options struct {
+	RoundRobin     bool    `mapstructure:"round_robin" json:"round_robin"`
+	Shuffle        bool    `mapstructure:"shuffle" json:"shuffle"`
+	Dedup          bool    `mapstructure:"dedup" json:"dedup"`
+	Pad            bool    `mapstructure:"pad" json:"pad"`
+	Seed           int64   `mapstructure:"seed" json:"seed,omitempty"`
+	ExcludeArtists bool    `mapstructure:"exclude_artists" json:"exclude_artists"`
+	Filters        Filters `mapstructure:"filters" json:"filters"`
+}
+
+// Filters mirrors mix.Filters.
+type Filters struct {
+	ExcludeExplicit     bool    `mapstructure:"exclude_explicit" json:"exclude_explicit"`
+	MinYear             int     `mapstructure:"min_year" json:"min_year,omitempty"`
+	MaxYear             int     `mapstructure:"max_year" json:"max_year,omitempty"`
+	MinPopularity       int     `mapstructure:"min_popularity" json:"min_popularity,omitempty"`
+	MaxPopularity       int     `mapstructure:"max_popularity" json:"max_popularity,omitempty"`
+	MinDuration         int     `mapstructure:"min_duration" json:"min_duration,omitempty"`
+	MaxDuration         int     `mapstructure:"max_duration" json:"max_duration,omitempty"`
+	MinTempo            float64 `mapstructure:"min_tempo" json:"min_tempo,omitempty"`
+	MaxTempo            float64 `mapstructure:"max_tempo" json:"max_tempo,omitempty"`
+	MinEnergy           float64 `mapstructure:"min_energy" json:"min_energy,omitempty"`
+	MaxEnergy           float64 `mapstructure:"max_energy" json:"max_energy,omitempty"`
+	MinDanceability     float64 `mapstructure:"min_danceability" json:"min_danceability,omitempty"`
+	MaxDanceability     float64 `mapstructure:"max_danceability" json:"max_danceability,omitempty"`
+	MinValence          float64 `mapstructure:"min_valence" json:"min_valence,omitempty"`
+	MaxValence          float64 `mapstructure:"max_valence" json:"max_valence,omitempty"`
+	MinAcousticness     float64 `mapstructure:"min_acousticness" json:"min_acousticness,omitempty"`
+	MaxAcousticness     float64 `mapstructure:"max_acousticness" json:"max_acousticness,omitempty"`
+	MinInstrumentalness float64 `mapstructure:"min_instrumentalness" json:"min_instrumentalness,omitempty"`
+	MaxInstrumentalness float64 `mapstructure:"max_instrumentalness" json:"max_instrumentalness,omitempty"`
+}
+
+// Recipe describes a mix.  Name is just a label for people reading
+// the recipe.  Tracks on any of the Exclude playlists are left out of
+// the mix.
+type Recipe struct {
+	Name        string     `mapstructure:"name" json:"name,omitempty"`
+	Sources     []Playlist `mapstructure:"sources" json:"sources"`
+	Exclude     []Playlist `mapstructure:"exclude" json:"exclude,omitempty"`
+	Destination Playlist   `mapstructure:"destination" json:"destination"`
+	Options     Options    `mapstructure:"options" json:"options"`
+}
+
+// Load reads a recipe from a file, working out its format from the
+// file's extension.
+func Load(path string) (Recipe, error) {
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if !supported(format) {
+		return Recipe{}, fmt.Errorf(
+			"%s: recipes must be %s files",
+			path,
+			strings.Join(Formats, ", "),
+		)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil {
+		return Recipe{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return unmarshal(v)
+}
+
+// Parse reads a recipe in the given format.
+func Parse(reader io.Reader, format string) (Recipe, error) {
+	if !supported(format) {
+		return Recipe{}, fmt.Errorf(
+			"unsupported recipe format %q, use %s",
+			format,
+			strings.Join(Formats, ", "),
+		)
+	}
+
+	v := viper.New()
+	v.SetConfigType(format)
+	err := v.ReadConfig(reader)
+	if err != nil {
+		return Recipe{}, err
+	}
+	return unmarshal(v)
+}
+
+// unmarshal decodes a recipe, rejecting any keys it doesn't know so
+// that typos don't silently get ignored.
+func unmarshal(v *viper.Viper) (Recipe, error) {
+	recipe := Recipe{}
+	err := v.UnmarshalExact(&recipe)
+	if err != nil {
+		return Recipe{}, fmt.Errorf("invalid recipe: %w", err)
+	}
+	return recipe, nil
+}
+
+func supported(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Request converts the recipe to a mix request, for playlists that
+// already have their IDs and owners filled in.  See Resolve.
+func (recipe Recipe) Request() mix.Request {
+	request := mix.Request{
+		DestList: mix.List{ID: recipe.Destination.ID},
+		Options: mix.Options{
+			RoundRobin:     recipe.Options.RoundRobin,
+			Shuffle:        recipe.Options.Shuffle,
+			Dedup:          recipe.Options.Dedup,
+			Pad:            recipe.Options.Pad,
+			Seed:           recipe.Options.Seed,
+			ExcludeArtists: recipe.Options.ExcludeArtists,
+			Filters:        mix.Filters(recipe.Options.Filters),
+		},
+	}
+	for _, source := range recipe.Sources {
+		request.SourceLists = append(request.SourceLists, mix.List{
+			ID:     source.ID,
+			Weight: source.Weight,
+		})
+	}
+	for _, exclude := range recipe.Exclude {
+		request.ExcludeLists = append(
+			request.ExcludeLists,
+			mix.List{ID: exclude.ID},
+		)
+	}
+	return request
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package recipe
+
+import (
+	"context"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	sourceID = "source0000000000000000"
+	destID   = "dest000000000000000000"
+)
+
+func TestParse(t *testing.T) {
+	want := Recipe{
+		Name: "Workout",
+		Sources: []Playlist{
+			{ID: sourceID, Weight: 2},
+			{Name: "Chill"},
+		},
+		Destination: Playlist{ID: destID},
+		Options: Options{
+			RoundRobin: true,
+			Filters:    Filters{MinYear: 1990, MinEnergy: 0.5},
+		},
+	}
+
+	tests := map[string]string{
+		"yaml": `
+name: Workout
+sources:
+  - id: ` + sourceID + `
+    weight: 2
+  - name: Chill
+destination:
+  id: ` + destID + `
+options:
+  round_robin: true
+  filters:
+    min_year: 1990
+    min_energy: 0.5
+`,
+		"toml": `
+name = "Workout"
+[[sources]]
+id = "` + sourceID + `"
+weight = 2
+[[sources]]
+name = "Chill"
+[destination]
+id = "` + destID + `"
+[options]
+round_robin = true
+[options.filters]
+min_year = 1990
+min_energy = 0.5
+`,
+		"json": `{
+	"name": "Workout",
+	"sources": [{"id": "` + sourceID + `", "weight": 2}, {"name": "Chill"}],
+	"destination": {"id": "` + destID + `"},
+	"options": {
+		"round_robin": true,
+		"filters": {"min_year": 1990, "min_energy": 0.5}
+	}
+}`,
+	}
+
+	for format, input := range tests {
+		t.Run(format, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(input), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+				t.Errorf("got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+	}{
+		{
+			name:   "unknown top level key",
+			format: "yaml",
+			input:  "sources: [{id: " + sourceID + "}]\nsauces: []\n",
+		},
+		{
+			name:   "unknown option",
+			format: "yaml",
+			input:  "options:\n  roundrobin: true\n",
+		},
+		{
+			name:   "unknown playlist key",
+			format: "json",
+			input:  `{"destination": {"id": "` + destID + `", "owner": "me"}}`,
+		},
+		{
+			name:   "unsupported format",
+			format: "ini",
+			input:  "name = Workout\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.input), test.format)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	recipe := Recipe{
+		Sources: []Playlist{
+			{},
+			{ID: sourceID, Name: "Both"},
+			{ID: "short"},
+		},
+		Exclude:     []Playlist{{Name: "Skip", Weight: 2}},
+		Destination: Playlist{Name: "Out", Weight: 1},
+	}
+
+	fields := []string{}
+	for _, problem := range recipe.Validate() {
+		fields = append(fields, problem.Field)
+	}
+	want := []string{
+		"sources[0]",
+		"sources[1]",
+		"sources[2].id",
+		"exclude[0].weight",
+		"destination.weight",
+	}
+	if fmt.Sprint(fields) != fmt.Sprint(want) {
+		t.Errorf("problems with %v, want %v", fields, want)
+	}
+}
+
+func TestRecipeField(t *testing.T) {
+	tests := map[string]string{
+		"source_lists":           "sources",
+		"source_lists[3].weight": "sources[3].weight",
+		"exclude_lists[0].id":    "exclude[0].id",
+		"dest_list.owner_id":     "destination.owner_id",
+		"options.seed":           "options.seed",
+	}
+	for field, want := range tests {
+		if got := recipeField(field); got != want {
+			t.Errorf("recipeField(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestResolveMapsFieldNames(t *testing.T) {
+	t.Cleanup(spotify.StubAPI(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			fmt.Fprintf(w, `{"id":%q,"owner":{"id":"me"}}`, id)
+		},
+	)))
+
+	// Excluding a source only shows up once the recipe has been
+	// turned into a mix request, so its field has to be translated
+	// back.
+	recipe := Recipe{
+		Sources:     []Playlist{{ID: sourceID}},
+		Exclude:     []Playlist{{ID: sourceID}},
+		Destination: Playlist{ID: destID},
+	}
+	_, problems, err := recipe.Resolve(
+		context.Background(),
+		spotify.AuthTokens{AccessToken: "token"},
+		"me",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Field != "exclude[0].id" {
+		t.Errorf("got %v, want a problem with exclude[0].id", problems)
+	}
+}
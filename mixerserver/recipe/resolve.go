@@ -0,0 +1,258 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package recipe
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"net/http"
+	"strings"
+)
+
+// Validate checks the parts of a recipe that can be checked without
+// calling the API, and returns every problem it finds.
+func (recipe Recipe) Validate() []mix.FieldError {
+	problems := []mix.FieldError{}
+
+	if len(recipe.Sources) == 0 {
+		problems = append(problems, mix.FieldError{
+			Field:   "sources",
+			Message: "At least one source playlist is required",
+		})
+	}
+	for i, source := range recipe.Sources {
+		problems = append(
+			problems,
+			validatePlaylist(fmt.Sprintf("sources[%d]", i), source)...,
+		)
+	}
+
+	for i, exclude := range recipe.Exclude {
+		field := fmt.Sprintf("exclude[%d]", i)
+		problems = append(problems, validatePlaylist(field, exclude)...)
+		if exclude.Weight != 0 {
+			problems = append(problems, mix.FieldError{
+				Field:   field + ".weight",
+				Message: "Only source playlists can have a weight",
+			})
+		}
+	}
+
+	problems = append(
+		problems,
+		validatePlaylist("destination", recipe.Destination)...,
+	)
+	if recipe.Destination.Weight != 0 {
+		problems = append(problems, mix.FieldError{
+			Field:   "destination.weight",
+			Message: "Only source playlists can have a weight",
+		})
+	}
+
+	return problems
+}
+
+// validatePlaylist makes sure a playlist reference has exactly one of
+// an ID or a name.
+func validatePlaylist(field string, playlist Playlist) []mix.FieldError {
+	switch {
+	case playlist.ID == "" && playlist.Name == "":
+		return []mix.FieldError{{
+			Field:   field,
+			Message: "Needs either an id or a name",
+		}}
+	case playlist.ID != "" && playlist.Name != "":
+		return []mix.FieldError{{
+			Field:   field,
+			Message: "Can't have both an id and a name",
+		}}
+	case playlist.ID != "" && !mix.IsPlaylistID(playlist.ID):
+		return []mix.FieldError{{
+			Field:   field + ".id",
+			Message: "Not a valid playlist ID",
+		}}
+	}
+	return nil
+}
+
+// Resolve validates the recipe and turns it into a mix request that's
+// ready to run on behalf of the given user.  Playlists named in the
+// recipe are looked up among the user's playlists, and every playlist
+// has its owner filled in.  Any problems with the recipe are returned
+// as field errors, with the fields named as they are in the recipe;
+// err is only set if the API calls fail.
+func (recipe Recipe) Resolve(
+	ctx gocontext.Context,
+	authTokens spotify.AuthTokens,
+	userID string,
+) (request mix.Request, problems []mix.FieldError, err error) {
+	problems = recipe.Validate()
+	if len(problems) != 0 {
+		return
+	}
+
+	request = recipe.Request()
+	resolver := &resolver{
+		ctx:        ctx,
+		authTokens: authTokens,
+		userID:     userID,
+	}
+
+	for i, source := range recipe.Sources {
+		field := fmt.Sprintf("sources[%d]", i)
+		list := &request.SourceLists[i]
+		problem, err := resolver.resolve(field, source, list)
+		if err != nil {
+			return request, nil, err
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+	for i, exclude := range recipe.Exclude {
+		field := fmt.Sprintf("exclude[%d]", i)
+		list := &request.ExcludeLists[i]
+		problem, err := resolver.resolve(field, exclude, list)
+		if err != nil {
+			return request, nil, err
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+	problem, err := resolver.resolve(
+		"destination",
+		recipe.Destination,
+		&request.DestList,
+	)
+	if err != nil {
+		return request, nil, err
+	}
+	if problem != nil {
+		problems = append(problems, *problem)
+	}
+	if len(problems) != 0 {
+		return
+	}
+
+	problems = request.Validate()
+	if len(problems) == 0 {
+		problems, err = request.ValidateOwnership(ctx, authTokens, userID)
+		if err != nil {
+			return request, nil, err
+		}
+	}
+	for i := range problems {
+		problems[i].Field = recipeField(problems[i].Field)
+	}
+	return
+}
+
+// resolver looks up playlists for Resolve, fetching the user's
+// playlists at most once.
+type resolver struct {
+	ctx        gocontext.Context
+	authTokens spotify.AuthTokens
+	userID     string
+	playlists  []spotify.Playlist
+}
+
+// resolve fills in list's ID and owner from a recipe playlist.
+func (r *resolver) resolve(
+	field string,
+	playlist Playlist,
+	list *mix.List,
+) (*mix.FieldError, error) {
+	if playlist.ID != "" {
+		found, err := spotify.GetPlaylist(r.ctx, r.authTokens, playlist.ID)
+		var apiErr *spotify.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return &mix.FieldError{
+				Field:   field + ".id",
+				Message: "No playlist with this ID",
+			}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		list.OwnerID = found.Owner.ID
+		return nil, nil
+	}
+
+	if r.playlists == nil {
+		playlists, err := spotify.GetPlaylists(
+			r.ctx,
+			r.authTokens,
+			r.userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.playlists = playlists
+	}
+
+	matches := []spotify.Playlist{}
+	for _, candidate := range r.playlists {
+		if strings.EqualFold(candidate.Name, playlist.Name) {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return &mix.FieldError{
+			Field:   field + ".name",
+			Message: "None of your playlists has this name",
+		}, nil
+	case 1:
+		list.ID = matches[0].ID
+		list.OwnerID = matches[0].Owner.ID
+		return nil, nil
+	default:
+		ids := []string{}
+		for _, match := range matches {
+			ids = append(ids, match.ID)
+		}
+		return &mix.FieldError{
+			Field: field + ".name",
+			Message: fmt.Sprintf(
+				"%d of your playlists have this name, use an id instead (%s)",
+				len(matches),
+				strings.Join(ids, ", "),
+			),
+		}, nil
+	}
+}
+
+// recipeField translates the name of a field in a mix request to the
+// name of the corresponding field in a recipe.
+func recipeField(field string) string {
+	for requestField, recipeField := range map[string]string{
+		"source_lists":  "sources",
+		"exclude_lists": "exclude",
+		"dest_list":     "destination",
+	} {
+		if strings.HasPrefix(field, requestField) {
+			return recipeField + strings.TrimPrefix(field, requestField)
+		}
+	}
+	return field
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/bieber/mixer/mixerserver/context"
 	"github.com/bieber/mixer/mixerserver/handlers"
 	"github.com/bieber/mixer/mixerserver/middleware"
+	"github.com/bieber/mixer/mixerserver/spotify"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/sebest/xff"
@@ -36,8 +37,20 @@ func initRoutes(
 	globalContext *context.GlobalContext,
 	staticResourcesPath string,
 ) {
-	r := mux.NewRouter().StrictSlash(true)
-	globalContext.Router = r
+	root := mux.NewRouter().StrictSlash(true)
+	globalContext.Router = root
+
+	// If the public URL has a path, everything gets mounted under it.
+	// Named routes live on the root router either way, so URLs built
+	// from them pick up the prefix automatically.
+	prefix := ""
+	if globalContext.PublicURL != nil {
+		prefix = globalContext.PublicURL.Path
+	}
+	r := root
+	if prefix != "" {
+		r = root.PathPrefix(prefix).Subrouter()
+	}
 
 	xffmw, err := xff.Default()
 	if err != nil {
@@ -46,31 +59,117 @@ func initRoutes(
 	basicStack := alice.New(
 		// This bottom instance of ErrorCatcher will catch any
 		// failures in the logging or cleanup code, as a last resort.
-		middleware.ErrorCatcher,
+		middleware.ErrorCatcher(globalContext, handlers.PlainErrors),
 		xffmw.Handler,
-		middleware.ContextCleaner,
+		middleware.HostChecker(globalContext),
+		middleware.Tracing,
+		middleware.RequestID,
 		middleware.Logger(globalContext),
-		middleware.ErrorCatcher,
+		middleware.Metrics,
+		middleware.SpotifyRetryLimit,
+	)
+
+	// Pages render errors with the error template, while API
+	// endpoints send JSON the client can act on.
+	pageStack := basicStack.Append(
+		middleware.ErrorCatcher(globalContext, handlers.HTMLErrors),
+	)
+	apiStack := basicStack.Append(
+		middleware.ErrorCatcher(globalContext, handlers.JSONErrors),
 	)
 
-	tokenStack := basicStack.Append(middleware.TokenParser)
+	tokenStack := apiStack.Append(middleware.TokenParser(globalContext))
+	scopedStack := func(features ...spotify.Feature) alice.Chain {
+		return tokenStack.Append(
+			middleware.ScopeChecker(globalContext, features...),
+		)
+	}
 
-	r.NotFoundHandler = basicStack.ThenFunc(handlers.FourOhFour)
+	root.NotFoundHandler = pageStack.ThenFunc(handlers.NotFound)
+	root.MethodNotAllowedHandler = apiStack.ThenFunc(
+		handlers.MethodNotAllowed,
+	)
 
-	r.Handle("/", basicStack.Then(handlers.Index(globalContext)))
-	r.Handle("/login/", basicStack.Then(handlers.Login(globalContext))).
+	r.Handle("/", pageStack.Then(handlers.Index(globalContext))).
+		Name("index")
+	r.Handle("/login/", pageStack.Then(handlers.Login(globalContext))).
 		Name("login")
 	r.Handle("/refresh/", tokenStack.Then(handlers.Refresh(globalContext))).
 		Name("refresh")
-	r.Handle("/playlists/", tokenStack.ThenFunc(handlers.Playlists)).
-		Name("playlists")
-	r.Handle("/submit/", tokenStack.Then(handlers.Submit(globalContext))).
-		Name("submit")
+	r.Handle("/logout/", tokenStack.Then(handlers.Logout(globalContext))).
+		Methods("POST").
+		Name("logout")
+	r.Handle(
+		"/playlists/",
+		scopedStack(spotify.FeaturePlaylists).ThenFunc(handlers.Playlists),
+	).Name("playlists")
+	r.Handle(
+		"/submit/",
+		scopedStack(spotify.FeatureMix).Then(handlers.Submit(globalContext)),
+	).Name("submit")
+	r.Handle(
+		"/recipe/",
+		scopedStack(spotify.FeaturePlaylists).ThenFunc(handlers.Recipe),
+	).Name("recipe")
+
+	scheduleStack := scopedStack(spotify.FeatureMix)
+	r.Handle(
+		"/schedules/",
+		scheduleStack.Then(handlers.Schedules(globalContext)),
+	).Methods("GET").Name("schedules")
+	r.Handle(
+		"/schedules/",
+		scheduleStack.Then(handlers.CreateSchedule(globalContext)),
+	).Methods("POST").Name("create_schedule")
+	r.Handle(
+		"/schedules/{id}/",
+		scheduleStack.Then(handlers.Schedule(globalContext)),
+	).Methods("GET").Name("schedule")
+	r.Handle(
+		"/schedules/{id}/",
+		scheduleStack.Then(handlers.DeleteSchedule(globalContext)),
+	).Methods("DELETE").Name("delete_schedule")
+	r.Handle(
+		"/schedules/{id}/runs/",
+		scheduleStack.Then(handlers.ScheduleRuns(globalContext)),
+	).Methods("GET").Name("schedule_runs")
+
+	historyStack := scopedStack(spotify.FeatureMix)
+	r.Handle(
+		"/history/",
+		historyStack.Then(handlers.History(globalContext)),
+	).Methods("GET").Name("history")
+	r.Handle(
+		"/history/{id}/",
+		historyStack.Then(handlers.HistoryEntry(globalContext)),
+	).Methods("GET").Name("history_entry")
+	r.Handle(
+		"/history/{id}/rerun/",
+		historyStack.Then(handlers.Rerun(globalContext)),
+	).Methods("POST").Name("rerun")
+
+	webhookStack := scopedStack(spotify.FeatureMix)
+	r.Handle(
+		"/webhooks/",
+		webhookStack.Then(handlers.Webhooks(globalContext)),
+	).Methods("GET").Name("webhooks")
+	r.Handle(
+		"/webhooks/",
+		webhookStack.Then(handlers.CreateWebhook(globalContext)),
+	).Methods("POST").Name("create_webhook")
+	r.Handle(
+		"/webhooks/{id}/",
+		webhookStack.Then(handlers.DeleteWebhook(globalContext)),
+	).Methods("DELETE").Name("delete_webhook")
+	r.Handle(
+		"/webhooks/{id}/deliveries/",
+		webhookStack.Then(handlers.WebhookDeliveries(globalContext)),
+	).Methods("GET").Name("webhook_deliveries")
 
 	staticHandler := func(subpath string) http.Handler {
-		return basicStack.Then(
+		return pageStack.Then(
 			http.StripPrefix(
-				path.Join("/static/", subpath),
+				path.Join(prefix, "/static/", subpath),
 				http.FileServer(
 					http.Dir(
 						filepath.Join(staticResourcesPath, subpath),
@@ -79,7 +178,7 @@ func initRoutes(
 			),
 		)
 	}
-	s := r.PathPrefix("/static").Subrouter()
+	s := r.PathPrefix("/static").Name("static").Subrouter()
 
 	s.Handle("/js/{rest:.*}", staticHandler("/js"))
 	s.Handle("/css/{rest:.*}", staticHandler("/css"))
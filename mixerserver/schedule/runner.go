@@ -0,0 +1,464 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package schedule
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/history"
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"github.com/robfig/cron/v3"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// checkInterval is how often the runner looks for schedules that have
+// come due.
+const checkInterval = 30 * time.Second
+
+// tokenExpiryMargin is how long before Spotify says an access token
+// expires that the runner stops using it.
+const tokenExpiryMargin = time.Minute
+
+// Runner starts scheduled mixes as they come due, or as their sources
+// change, as jobs on the same manager the server's submitted mixes run
+// on.
+type Runner struct {
+	Store        *store.Store
+	Jobs         *jobs.Manager
+	Webhooks     *webhook.Dispatcher
+	Logger       *slog.Logger
+	ClientID     string
+	ClientSecret string
+	// WatchInterval is how often watched schedules' sources are
+	// checked for changes.  Watching is disabled if it's zero.
+	WatchInterval time.Duration
+	// WatchDebounce is how long a source's changes have to settle
+	// before the mix runs, so a burst of edits only rewrites the
+	// playlist once.
+	WatchDebounce time.Duration
+
+	// mutex guards tokens, refreshLocks and running, which are
+	// keyed by schedule.
+	mutex        sync.Mutex
+	tokens       map[string]cachedTokens
+	refreshLocks map[string]*sync.Mutex
+	running      map[string]bool
+	watches      map[string]*watchState
+}
+
+// errRunning is returned by start when the schedule's last mix is
+// still going.
+var errRunning = errors.New("Schedule is already running")
+
+// cachedTokens are auth tokens refreshed for a schedule, kept until
+// shortly before the access token expires.
+type cachedTokens struct {
+	authTokens spotify.AuthTokens
+	expires    time.Time
+}
+
+// Run checks for due schedules and changed sources until ctx is
+// cancelled.  Schedules that came due while the server was down run
+// once as soon as it starts.
+func (r *Runner) Run(ctx gocontext.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	var watchTicks <-chan time.Time
+	if r.WatchInterval > 0 {
+		watchTicker := time.NewTicker(r.WatchInterval)
+		defer watchTicker.Stop()
+		watchTicks = watchTicker.C
+	}
+
+	r.startDue(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.startDue(time.Now())
+		case <-watchTicks:
+			r.checkWatched(ctx, time.Now())
+		}
+	}
+}
+
+// startDue starts a job for every schedule due at or before now, and
+// moves each one on to its next run.  It also forgets the tokens of
+// schedules that have been deleted.
+func (r *Runner) startDue(now time.Time) {
+	due := []record{}
+	// Anything cached for a schedule that isn't in the store any
+	// more belongs to one that's been deleted.
+	deleted := map[string]bool{}
+	r.mutex.Lock()
+	for key := range r.tokens {
+		deleted[key] = true
+	}
+	for key := range r.refreshLocks {
+		deleted[key] = true
+	}
+	r.mutex.Unlock()
+	err := r.Store.ForEach(
+		schedulesBucket,
+		"",
+		func(key string, value []byte) error {
+			rec := record{}
+			err := json.Unmarshal(value, &rec)
+			if err != nil {
+				return err
+			}
+			delete(deleted, key)
+			if rec.NextRun != nil && !rec.NextRun.After(now) {
+				due = append(due, rec)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		r.Logger.Error("couldn't list schedules", "error", err)
+		return
+	}
+	r.forget(deleted)
+
+	for _, rec := range due {
+		logger := r.Logger.With("schedule_id", rec.ID, "user_id", rec.UserID)
+
+		// Moving the schedule on before the job starts means a
+		// crash partway through won't run it again on restart.
+		err := r.update(rec.UserID, rec.ID, func(stored *record) error {
+			parsed, err := cron.ParseStandard(stored.Cron)
+			if err != nil {
+				return err
+			}
+			next := parsed.Next(now)
+			stored.NextRun = &next
+			return nil
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			logger.Error("couldn't update schedule", "error", err)
+			continue
+		}
+
+		err = r.start(rec, TriggerCron, logger)
+		if errors.Is(err, jobs.ErrClosed) {
+			return
+		}
+	}
+}
+
+// start runs a schedule's mix as a new job.  It returns jobs.ErrClosed
+// once the server has started shutting down, and errRunning without
+// starting anything if the schedule's last mix hasn't finished, so
+// two mixes never write the same destination at once.
+func (r *Runner) start(rec record, trigger string, logger *slog.Logger) error {
+	key := scheduleKey(rec.UserID, rec.ID)
+	r.mutex.Lock()
+	if r.running[key] {
+		r.mutex.Unlock()
+		logger.Warn(
+			"skipping scheduled mix, the last one is still running",
+			"trigger", trigger,
+		)
+		return errRunning
+	}
+	if r.running == nil {
+		r.running = map[string]bool{}
+	}
+	r.running[key] = true
+	r.mutex.Unlock()
+
+	jobID, err := crypto.GenerateNonce()
+	if err == nil {
+		ctx := context.Detach(
+			context.WithLogger(gocontext.Background(), logger),
+			jobID,
+		)
+		err = r.Jobs.Start(ctx, func(ctx gocontext.Context) {
+			defer r.finished(key)
+			r.execute(ctx, rec, trigger)
+		})
+	}
+	if err != nil {
+		r.finished(key)
+	}
+
+	if errors.Is(err, jobs.ErrClosed) {
+		logger.Warn("skipping scheduled mix while shutting down")
+	} else if err != nil {
+		logger.Error("couldn't start scheduled mix", "error", err)
+	}
+	return err
+}
+
+// isRunning reports whether the schedule with the given key has a mix
+// in progress.
+func (r *Runner) isRunning(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.running[key]
+}
+
+// finished marks the schedule with the given key as no longer
+// running.
+func (r *Runner) finished(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.running, key)
+}
+
+// execute runs a scheduled mix and records how it went.
+func (r *Runner) execute(
+	ctx gocontext.Context,
+	rec record,
+	trigger string,
+) {
+	run := Run{
+		JobID:   context.JobID(ctx),
+		Trigger: trigger,
+		Started: time.Now(),
+	}
+
+	result, err := r.mix(ctx, rec, trigger)
+
+	run.Finished = time.Now()
+	run.Outcome = mix.Outcome(err)
+	run.Tracks = len(result.TrackIDs)
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	err = r.recordRun(rec, run)
+	if err != nil {
+		context.Logger(ctx).Error(
+			"couldn't record scheduled run",
+			"error", err,
+		)
+	}
+}
+
+// mix authenticates as the schedule's owner and runs its mix, adding
+// it to their history.
+func (r *Runner) mix(
+	ctx gocontext.Context,
+	rec record,
+	trigger string,
+) (mix.Result, error) {
+	authTokens, err := r.authTokens(ctx, rec)
+	if err != nil {
+		return mix.Result{}, err
+	}
+	return history.RunJob(
+		ctx,
+		r.Store,
+		r.Webhooks,
+		authTokens,
+		history.Entry{
+			UserID:     rec.UserID,
+			Trigger:    trigger,
+			ScheduleID: rec.ID,
+			Request:    rec.Request,
+		},
+	)
+}
+
+// authTokens returns auth tokens for a schedule's owner, refreshing
+// them with the schedule's refresh token if there aren't any cached
+// that are still good.  Only one refresh runs at a time for each
+// schedule, since Spotify may rotate the refresh token, but different
+// schedules refresh independently.
+func (r *Runner) authTokens(
+	ctx gocontext.Context,
+	rec record,
+) (spotify.AuthTokens, error) {
+	log := context.Logger(ctx)
+	key := scheduleKey(rec.UserID, rec.ID)
+
+	if authTokens, ok := r.cachedTokens(key); ok {
+		return authTokens, nil
+	}
+
+	lock := r.refreshLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Someone else may have refreshed them while we waited.
+	if authTokens, ok := r.cachedTokens(key); ok {
+		return authTokens, nil
+	}
+
+	// The stored token may have been rotated since rec was read.
+	stored, err := get(r.Store, rec.UserID, rec.ID)
+	if err != nil {
+		return spotify.AuthTokens{}, err
+	}
+
+	refreshToken, err := crypto.Decrypt(stored.RefreshToken)
+	if err != nil {
+		log.Error("couldn't decrypt refresh token", "error", err)
+		return spotify.AuthTokens{}, err
+	}
+
+	authTokens, err := spotify.RefreshAuthTokens(
+		ctx,
+		spotify.AuthTokens{RefreshToken: refreshToken, Scope: stored.Scope},
+		r.ClientID,
+		r.ClientSecret,
+	)
+	if err != nil {
+		log.Error("couldn't refresh auth tokens", "error", err)
+		return spotify.AuthTokens{}, fmt.Errorf(
+			"couldn't refresh auth tokens: %w",
+			err,
+		)
+	}
+
+	// Spotify rotates refresh tokens for public clients, so hang on
+	// to the new one for next time.
+	if authTokens.RefreshToken != refreshToken {
+		encryptedToken, err := crypto.Encrypt(authTokens.RefreshToken)
+		if err == nil {
+			err = r.update(rec.UserID, rec.ID, func(stored *record) error {
+				stored.RefreshToken = encryptedToken
+				stored.Scope = authTokens.Scope
+				return nil
+			})
+		}
+		if err != nil {
+			log.Error("couldn't save rotated refresh token", "error", err)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.tokens == nil {
+		r.tokens = map[string]cachedTokens{}
+	}
+	r.tokens[key] = cachedTokens{
+		authTokens: authTokens,
+		expires: time.Now().Add(
+			time.Duration(authTokens.ExpiresIn)*time.Second -
+				tokenExpiryMargin,
+		),
+	}
+	return authTokens, nil
+}
+
+// cachedTokens returns the cached auth tokens for the schedule with
+// the given key, if there are any that are still good.
+func (r *Runner) cachedTokens(key string) (spotify.AuthTokens, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cached, ok := r.tokens[key]
+	if !ok || !time.Now().Before(cached.expires) {
+		return spotify.AuthTokens{}, false
+	}
+	return cached.authTokens, true
+}
+
+// refreshLock returns the lock that serializes token refreshes for
+// the schedule with the given key.
+func (r *Runner) refreshLock(key string) *sync.Mutex {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.refreshLocks == nil {
+		r.refreshLocks = map[string]*sync.Mutex{}
+	}
+	lock, ok := r.refreshLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.refreshLocks[key] = lock
+	}
+	return lock
+}
+
+// forget drops the cached tokens and refresh locks of the schedules
+// with the given keys, once they've been deleted.
+func (r *Runner) forget(keys map[string]bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key := range keys {
+		delete(r.tokens, key)
+		delete(r.refreshLocks, key)
+	}
+}
+
+// recordRun adds a run to a schedule's history, dropping the oldest
+// runs past maxRuns.
+func (r *Runner) recordRun(rec record, run Run) error {
+	err := r.update(rec.UserID, rec.ID, func(stored *record) error {
+		stored.LastRun = &run
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		// The schedule was deleted while it ran, so nothing will
+		// need its tokens again.
+		r.forget(map[string]bool{scheduleKey(rec.UserID, rec.ID): true})
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	runID, err := r.Store.NextID(runsBucket)
+	if err != nil {
+		return err
+	}
+	return r.Store.PutPruned(
+		runsBucket,
+		runKey(rec.UserID, rec.ID, runID),
+		run,
+		scheduleKey(rec.UserID, rec.ID)+"/",
+		maxRuns,
+	)
+}
+
+// update modifies a stored schedule in place.
+func (r *Runner) update(
+	userID string,
+	id string,
+	modify func(*record) error,
+) error {
+	rec := record{}
+	err := r.Store.Update(
+		schedulesBucket,
+		scheduleKey(userID, id),
+		&rec,
+		func() error { return modify(&rec) },
+	)
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package schedule
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowRefresh stubs out the Spotify API so that refreshing the "slow"
+// refresh token blocks until release is closed, while any other
+// refresh token goes straight through.  Anything other than a token
+// refresh gets a 404.  entered gets a value each time a slow refresh
+// starts.
+func slowRefresh(t *testing.T) (entered chan struct{}, release chan struct{}) {
+	entered = make(chan struct{}, 10)
+	release = make(chan struct{})
+
+	t.Cleanup(spotify.StubAPI(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/token" {
+				http.NotFound(w, r)
+				return
+			}
+			refreshToken := r.FormValue("refresh_token")
+			if refreshToken == "slow" {
+				entered <- struct{}{}
+				<-release
+			}
+			fmt.Fprintf(
+				w,
+				`{"access_token":"access-%s","refresh_token":%q,`+
+					`"expires_in":3600}`,
+				refreshToken,
+				refreshToken,
+			)
+		},
+	)))
+	return entered, release
+}
+
+// newTestRunner creates a runner on an empty store.
+func newTestRunner(t *testing.T) *Runner {
+	key, err := crypto.GenerateAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = crypto.SetAESKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := store.Open(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return &Runner{
+		Store:    st,
+		Jobs:     jobs.NewManager(),
+		Webhooks: webhook.NewDispatcher(st, logger, webhook.Config{}),
+		Logger:   logger,
+	}
+}
+
+func testRequest() mix.Request {
+	return mix.Request{
+		SourceLists: []mix.List{
+			{ID: "source0000000000000000", OwnerID: "user"},
+		},
+		DestList: mix.List{ID: "dest000000000000000000", OwnerID: "user"},
+	}
+}
+
+func createTestSchedule(t *testing.T, r *Runner, refreshToken string) record {
+	created, err := Create(
+		r.Store,
+		"user",
+		refreshToken,
+		"",
+		true,
+		testRequest(),
+		spotify.AuthTokens{RefreshToken: refreshToken},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := get(r.Store, "user", created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestAuthTokensRefreshIndependently(t *testing.T) {
+	r := newTestRunner(t)
+	entered, release := slowRefresh(t)
+	slow := createTestSchedule(t, r, "slow")
+	fast := createTestSchedule(t, r, "fast")
+	ctx := gocontext.Background()
+
+	slowDone := make(chan error)
+	go func() {
+		_, err := r.authTokens(ctx, slow)
+		slowDone <- err
+	}()
+	<-entered
+
+	fastDone := make(chan error)
+	go func() {
+		authTokens, err := r.authTokens(ctx, fast)
+		if err == nil && authTokens.AccessToken != "access-fast" {
+			err = fmt.Errorf("got access token %q", authTokens.AccessToken)
+		}
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("refresh blocked behind another schedule's refresh")
+	}
+
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// The refreshed tokens are cached, so this doesn't block again.
+	authTokens, err := r.authTokens(ctx, slow)
+	if err != nil || authTokens.AccessToken != "access-slow" {
+		t.Errorf("cached tokens = %v, %v", authTokens, err)
+	}
+}
+
+func TestStartSkipsRunningSchedule(t *testing.T) {
+	r := newTestRunner(t)
+	entered, release := slowRefresh(t)
+	rec := createTestSchedule(t, r, "slow")
+	logger := r.Logger
+
+	err := r.start(rec, TriggerCron, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+
+	err = r.start(rec, TriggerWatch, logger)
+	if !errors.Is(err, errRunning) {
+		t.Errorf("second start = %v, want errRunning", err)
+	}
+
+	close(release)
+	err = r.Jobs.Wait(gocontext.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.isRunning(scheduleKey(rec.UserID, rec.ID)) {
+		t.Error("schedule still marked running after its job finished")
+	}
+
+	// Now the first run is over, the next one goes ahead.  It gets
+	// its tokens from the cache, so there's no refresh to wait on.
+	err = r.start(rec, TriggerCron, logger)
+	if err != nil {
+		t.Errorf("start after finishing = %v", err)
+	}
+	r.Jobs.Close()
+	r.Jobs.Wait(gocontext.Background())
+}
+
+// hasTokens reports whether the runner is holding a cached token or
+// refresh lock for the schedule with the given key.
+func hasTokens(r *Runner, key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, cached := r.tokens[key]
+	_, locked := r.refreshLocks[key]
+	return cached || locked
+}
+
+func TestStartDueForgetsDeletedSchedules(t *testing.T) {
+	r := newTestRunner(t)
+	slowRefresh(t)
+	deleted := createTestSchedule(t, r, "fast")
+	kept := createTestSchedule(t, r, "fast")
+	ctx := gocontext.Background()
+
+	for _, rec := range []record{deleted, kept} {
+		_, err := r.authTokens(ctx, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := Delete(r.Store, deleted.UserID, deleted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.startDue(time.Now())
+	if hasTokens(r, scheduleKey(deleted.UserID, deleted.ID)) {
+		t.Error("tokens kept for a deleted schedule")
+	}
+	if !hasTokens(r, scheduleKey(kept.UserID, kept.ID)) {
+		t.Error("tokens dropped for a schedule that still exists")
+	}
+}
+
+func TestRunForgetsScheduleDeletedWhileRunning(t *testing.T) {
+	r := newTestRunner(t)
+	entered, release := slowRefresh(t)
+	rec := createTestSchedule(t, r, "slow")
+
+	err := r.start(rec, TriggerCron, r.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	err = Delete(r.Store, rec.UserID, rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	r.Jobs.Close()
+	err = r.Jobs.Wait(gocontext.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasTokens(r, scheduleKey(rec.UserID, rec.ID)) {
+		t.Error("tokens kept after a deleted schedule's last run")
+	}
+}
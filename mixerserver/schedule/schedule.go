@@ -0,0 +1,272 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package schedule implements recurring mixes: a mix request paired
+// with a cron expression, a watch on its source playlists, or both,
+// run on behalf of the user who created it with the refresh token
+// they had at the time.  Schedules and the history of their runs live
+// in the store, and a Runner started with the server kicks off each
+// one as it comes due or its sources change.
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/mix"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+const (
+	schedulesBucket = "schedules"
+	runsBucket      = "schedule_runs"
+)
+
+// maxRuns is the number of runs kept in each schedule's history.
+const maxRuns = 50
+
+// MinInterval is the shortest time allowed between two runs of a
+// schedule.
+const MinInterval = 15 * time.Minute
+
+// ErrNotFound is returned when a schedule doesn't exist, or belongs
+// to someone else.
+var ErrNotFound = errors.New("Schedule not found")
+
+// ErrNoTrigger is returned when creating a schedule with neither a
+// cron expression nor a watch on its sources.
+var ErrNoTrigger = errors.New("needs a cron expression or a watch")
+
+// What started a run.
+const (
+	TriggerCron  = "cron"
+	TriggerWatch = "watch"
+)
+
+// Schedule is a recurring mix.  Cron is a standard five field cron
+// expression (or a descriptor like @weekly), optionally prefixed with
+// CRON_TZ=<zone> to run in a time zone other than the server's.  If
+// Watch is set, the mix also runs whenever one of its source playlists
+// changes, and Snapshots holds the snapshot ID each source had as of
+// the last such run.
+type Schedule struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Name      string            `json:"name"`
+	Cron      string            `json:"cron,omitempty"`
+	Watch     bool              `json:"watch"`
+	Request   mix.Request       `json:"request"`
+	Created   time.Time         `json:"created"`
+	NextRun   *time.Time        `json:"next_run,omitempty"`
+	Snapshots map[string]string `json:"snapshots,omitempty"`
+	LastRun   *Run              `json:"last_run,omitempty"`
+}
+
+// Run records a single run of a schedule.
+type Run struct {
+	JobID    string    `json:"job_id"`
+	Trigger  string    `json:"trigger"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Outcome  string    `json:"outcome"`
+	Tracks   int       `json:"tracks"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// record is how a schedule is kept in the store, along with the
+// refresh token it runs with and the scopes that token was granted.
+// The token is encrypted with the server's token key, and never
+// leaves the server.
+type record struct {
+	Schedule
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// ParseCron parses a schedule's cron expression, and makes sure it
+// doesn't fire more often than MinInterval.
+func ParseCron(expression string) (cron.Schedule, error) {
+	parsed, err := cron.ParseStandard(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cron schedules can be irregular, so check a few runs ahead
+	// rather than just the first gap.
+	t := parsed.Next(time.Now())
+	for i := 0; i < 10 && !t.IsZero(); i++ {
+		next := parsed.Next(t)
+		if !next.IsZero() && next.Sub(t) < MinInterval {
+			return nil, fmt.Errorf(
+				"runs more often than every %s",
+				MinInterval,
+			)
+		}
+		t = next
+	}
+	return parsed, nil
+}
+
+// scheduleKey is the key a user's schedule is stored under.  User IDs
+// can't contain slashes, so all of a user's schedules share the user
+// ID and a slash as a prefix.
+func scheduleKey(userID string, id string) string {
+	return userID + "/" + id
+}
+
+// runKey is the key a run of a schedule is stored under, sorting in
+// the order the runs happened.
+func runKey(userID string, id string, runID string) string {
+	return scheduleKey(userID, id) + "/" + runID
+}
+
+// Create stores a new schedule for the given user, to run with the
+// refresh token from their auth tokens.  The cron expression may be
+// empty if the schedule watches its sources.  The request should
+// already be validated.
+func Create(
+	st *store.Store,
+	userID string,
+	name string,
+	expression string,
+	watch bool,
+	request mix.Request,
+	authTokens spotify.AuthTokens,
+) (Schedule, error) {
+	now := time.Now()
+	var nextRun *time.Time
+	if expression != "" {
+		parsed, err := ParseCron(expression)
+		if err != nil {
+			return Schedule{}, err
+		}
+		next := parsed.Next(now)
+		nextRun = &next
+	} else if !watch {
+		return Schedule{}, ErrNoTrigger
+	}
+
+	encryptedToken, err := crypto.Encrypt(authTokens.RefreshToken)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	id, err := st.NextID(schedulesBucket)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	rec := record{
+		Schedule: Schedule{
+			ID:      id,
+			UserID:  userID,
+			Name:    name,
+			Cron:    expression,
+			Watch:   watch,
+			Request: request,
+			Created: now,
+			NextRun: nextRun,
+		},
+		RefreshToken: encryptedToken,
+		Scope:        authTokens.Scope,
+	}
+	err = st.Put(schedulesBucket, scheduleKey(userID, id), rec)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return rec.Schedule, nil
+}
+
+// List returns all of a user's schedules.
+func List(st *store.Store, userID string) ([]Schedule, error) {
+	schedules := []Schedule{}
+	err := st.ForEach(
+		schedulesBucket,
+		userID+"/",
+		func(key string, value []byte) error {
+			rec := record{}
+			err := json.Unmarshal(value, &rec)
+			if err != nil {
+				return err
+			}
+			schedules = append(schedules, rec.Schedule)
+			return nil
+		},
+	)
+	return schedules, err
+}
+
+// Get returns one of a user's schedules.
+func Get(st *store.Store, userID string, id string) (Schedule, error) {
+	rec, err := get(st, userID, id)
+	return rec.Schedule, err
+}
+
+func get(st *store.Store, userID string, id string) (record, error) {
+	rec := record{}
+	err := st.Get(schedulesBucket, scheduleKey(userID, id), &rec)
+	if errors.Is(err, store.ErrNotFound) {
+		return rec, ErrNotFound
+	}
+	return rec, err
+}
+
+// Delete removes one of a user's schedules, along with its history.
+func Delete(st *store.Store, userID string, id string) error {
+	_, err := get(st, userID, id)
+	if err != nil {
+		return err
+	}
+
+	err = st.Delete(schedulesBucket, scheduleKey(userID, id))
+	if err != nil {
+		return err
+	}
+
+	return st.DeletePrefix(runsBucket, scheduleKey(userID, id)+"/")
+}
+
+// Runs returns the history of one of a user's schedules, most recent
+// first.
+func Runs(st *store.Store, userID string, id string) ([]Run, error) {
+	_, err := get(st, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []Run{}
+	err = st.ForEach(
+		runsBucket,
+		scheduleKey(userID, id)+"/",
+		func(key string, value []byte) error {
+			run := Run{}
+			err := json.Unmarshal(value, &run)
+			if err != nil {
+				return err
+			}
+			runs = append([]Run{run}, runs...)
+			return nil
+		},
+	)
+	return runs, err
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package schedule
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"maps"
+	"time"
+)
+
+// maxWatchBackoff caps how long the runner waits before checking a
+// schedule's sources again after failing to.
+const maxWatchBackoff = 6 * time.Hour
+
+// watchState is what the runner remembers about a watched schedule
+// between checks.  It's only touched from the goroutine calling Run,
+// and doesn't survive a restart.
+type watchState struct {
+	// pending holds source snapshots that differ from the ones the
+	// mix last ran against, and changed is when they last changed.
+	pending map[string]string
+	changed time.Time
+	// failures counts consecutive failed checks, and retryAt is when
+	// the next one is allowed.
+	failures int
+	retryAt  time.Time
+}
+
+// checkWatched checks the sources of every watched schedule, and
+// starts a mix for each one whose sources have changed since its last
+// run and have been left alone for at least WatchDebounce.
+func (r *Runner) checkWatched(ctx gocontext.Context, now time.Time) {
+	watched := []record{}
+	keys := map[string]bool{}
+	err := r.Store.ForEach(
+		schedulesBucket,
+		"",
+		func(key string, value []byte) error {
+			rec := record{}
+			err := json.Unmarshal(value, &rec)
+			if err != nil {
+				return err
+			}
+			keys[key] = true
+			if rec.Watch {
+				watched = append(watched, rec)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		r.Logger.Error("couldn't list schedules", "error", err)
+		return
+	}
+
+	// Forget about schedules that have been deleted.
+	if r.watches == nil {
+		r.watches = map[string]*watchState{}
+	}
+	maps.DeleteFunc(r.watches, func(key string, _ *watchState) bool {
+		return !keys[key]
+	})
+
+	for _, rec := range watched {
+		if ctx.Err() != nil {
+			return
+		}
+
+		key := scheduleKey(rec.UserID, rec.ID)
+		state, ok := r.watches[key]
+		if !ok {
+			state = &watchState{}
+			r.watches[key] = state
+		}
+		if now.Before(state.retryAt) {
+			continue
+		}
+
+		logger := r.Logger.With("schedule_id", rec.ID, "user_id", rec.UserID)
+		snapshots, err := r.snapshots(context.WithLogger(ctx, logger), rec)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			state.failures++
+			delay := r.backoff(state.failures, err)
+			state.retryAt = now.Add(delay)
+			logger.Warn(
+				"couldn't check sources",
+				"error", err,
+				"failures", state.failures,
+				"retry_in", delay,
+			)
+			continue
+		}
+		state.failures = 0
+
+		if rec.Snapshots == nil {
+			// This is the first check since the schedule was
+			// created, so just note where the sources are.
+			err = r.update(rec.UserID, rec.ID, func(stored *record) error {
+				stored.Snapshots = snapshots
+				return nil
+			})
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				logger.Error("couldn't update schedule", "error", err)
+			}
+			continue
+		}
+
+		if maps.Equal(snapshots, rec.Snapshots) {
+			state.pending = nil
+			continue
+		}
+		if !maps.Equal(snapshots, state.pending) {
+			logger.Debug("sources changed")
+			state.pending = snapshots
+			state.changed = now
+		}
+		if now.Sub(state.changed) < r.WatchDebounce {
+			continue
+		}
+		// Leave the change pending until the last mix finishes, so
+		// it gets picked up on a later check.
+		if r.isRunning(key) {
+			continue
+		}
+
+		// As with cron schedules, the schedule is moved on before
+		// the job starts, so a failed mix waits for the next change
+		// rather than retrying on every check.
+		err = r.update(rec.UserID, rec.ID, func(stored *record) error {
+			stored.Snapshots = snapshots
+			return nil
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			logger.Error("couldn't update schedule", "error", err)
+			continue
+		}
+		state.pending = nil
+
+		rec.Snapshots = snapshots
+		err = r.start(rec, TriggerWatch, logger)
+		if errors.Is(err, jobs.ErrClosed) {
+			return
+		}
+	}
+}
+
+// snapshots fetches the current snapshot ID of each of a schedule's
+// sources, and of its exclusion playlists, since changing those
+// changes the mix too.
+func (r *Runner) snapshots(
+	ctx gocontext.Context,
+	rec record,
+) (map[string]string, error) {
+	authTokens, err := r.authTokens(ctx, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := map[string]string{}
+	ids := append(rec.Request.SourceIDs(), rec.Request.ExcludeIDs()...)
+	for _, id := range ids {
+		playlist, err := spotify.GetPlaylist(ctx, authTokens, id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[id] = playlist.SnapshotID
+	}
+	return snapshots, nil
+}
+
+// backoff returns how long to wait after the given number of
+// consecutive failures, doubling the watch interval each time, or
+// however long Spotify asked for if that's longer.
+func (r *Runner) backoff(failures int, err error) time.Duration {
+	delay := r.WatchInterval
+	for i := 1; i < failures && delay < maxWatchBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxWatchBackoff)
+
+	spotifyErr := &spotify.Error{}
+	if errors.As(err, &spotifyErr) && spotifyErr.RetryAfter > delay {
+		delay = spotifyErr.RetryAfter
+	}
+	return delay
+}
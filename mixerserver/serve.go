@@ -0,0 +1,244 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/config"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"github.com/bieber/mixer/mixerserver/schedule"
+	"github.com/bieber/mixer/mixerserver/session"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"github.com/bieber/mixer/mixerserver/tracing"
+	"github.com/bieber/mixer/mixerserver/webhook"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// webhookDrainTimeout is how long to wait on shutdown for webhook
+// deliveries still in progress.
+const webhookDrainTimeout = 10 * time.Second
+
+// newServeCommand creates the serve command, which runs the web
+// server until it's interrupted.
+func newServeCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "serve",
+		Short: "Run the web server",
+		Long: `Run the web server until SIGINT or SIGTERM, then stop accepting
+new mixes and wait for running ones to finish before exiting.`,
+		Args:    cobra.NoArgs,
+		PreRunE: bindConfigFlags,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServer()
+		},
+	}
+	config.AddFlags(command.Flags())
+	return command
+}
+
+// runServer loads the config, sets up everything the server needs and
+// serves until it's shut down.
+func runServer() error {
+	err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	logger, err := newLogger(
+		os.Stderr,
+		viper.GetString("log_format"),
+		viper.GetString("log_level"),
+	)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	if config.FileUsed() == "" {
+		logger.Info("no config file found, using environment only")
+	}
+
+	err = crypto.SetAESKey(viper.GetString("token_key"))
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Init(
+		gocontext.Background(),
+		viper.GetString("tracing_exporter"),
+	)
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(viper.GetString("store_path"))
+	if err != nil {
+		return fmt.Errorf("couldn't open store: %w", err)
+	}
+	defer db.Close()
+
+	globalContext := &context.GlobalContext{
+		Logger: logger,
+		Jobs:   jobs.NewManager(),
+		Store:  db,
+		Webhooks: webhook.NewDispatcher(
+			db,
+			logger.With("component", "webhooks"),
+			webhook.Config{
+				URLs:         viper.GetStringSlice("webhook_urls"),
+				Secret:       viper.GetString("webhook_secret"),
+				Events:       viper.GetStringSlice("webhook_events"),
+				AllowPrivate: viper.GetBool("webhook_allow_private"),
+			},
+		),
+	}
+	globalContext.Spotify.ClientID = viper.GetString("spotify_client_id")
+	globalContext.Spotify.ClientSecret = viper.GetString(
+		"spotify_client_secret",
+	)
+
+	globalContext.Spotify.Scopes = config.FeatureScopes()
+	for _, feature := range viper.GetStringSlice("spotify_login_features") {
+		globalContext.Spotify.LoginFeatures = append(
+			globalContext.Spotify.LoginFeatures,
+			spotify.Feature(feature),
+		)
+	}
+
+	globalContext.PublicURL, err = config.PublicURL()
+	if err != nil {
+		return err
+	}
+	globalContext.AllowedHosts = viper.GetStringSlice("allowed_hosts")
+	if len(globalContext.AllowedHosts) == 0 && globalContext.PublicURL != nil {
+		globalContext.AllowedHosts = []string{globalContext.PublicURL.Host}
+	}
+	// We can only get certificates for the autocert hosts, so there's
+	// no point answering to any others.
+	if len(globalContext.AllowedHosts) == 0 {
+		globalContext.AllowedHosts = viper.GetStringSlice(
+			"tls_autocert_hosts",
+		)
+	}
+
+	globalContext.Sessions.Lifetime = viper.GetDuration("session_lifetime")
+	globalContext.Sessions.DenyList = session.NewDenyList(db)
+
+	initRoutes(globalContext, viper.GetString("static_path"))
+
+	err = initTemplates(globalContext, viper.GetString("static_path"))
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, plainHandler, certCloser, err := initTLS(globalContext)
+	if err != nil {
+		return err
+	}
+	if certCloser != nil {
+		defer certCloser.Close()
+	}
+
+	servers := []*http.Server{}
+	if tlsConfig == nil {
+		servers = append(servers, &http.Server{
+			Addr:              fmt.Sprintf(":%d", viper.GetInt("port")),
+			Handler:           globalContext.Router,
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+		logger.Info("starting server", "port", viper.GetInt("port"))
+	} else {
+		// With TLS enabled the plain HTTP port just redirects to
+		// HTTPS (and answers ACME challenges, if need be).
+		servers = append(
+			servers,
+			&http.Server{
+				Addr:              fmt.Sprintf(":%d", viper.GetInt("tls_port")),
+				Handler:           globalContext.Router,
+				TLSConfig:         tlsConfig,
+				ReadHeaderTimeout: 10 * time.Second,
+			},
+			&http.Server{
+				Addr:              fmt.Sprintf(":%d", viper.GetInt("port")),
+				Handler:           plainHandler,
+				ReadHeaderTimeout: 10 * time.Second,
+			},
+		)
+		logger.Info(
+			"starting server",
+			"port", viper.GetInt("port"),
+			"tls_port", viper.GetInt("tls_port"),
+		)
+	}
+
+	// Metrics get a listener of their own, so they can be kept off
+	// the public network.
+	if metricsAddr := viper.GetString("metrics_addr"); metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		servers = append(servers, &http.Server{
+			Addr:              metricsAddr,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+		logger.Info("serving metrics", "addr", metricsAddr)
+	}
+
+	runnerCtx, stopRunner := gocontext.WithCancel(gocontext.Background())
+	runner := &schedule.Runner{
+		Store:         db,
+		Jobs:          globalContext.Jobs,
+		Webhooks:      globalContext.Webhooks,
+		Logger:        logger.With("component", "scheduler"),
+		ClientID:      globalContext.Spotify.ClientID,
+		ClientSecret:  globalContext.Spotify.ClientSecret,
+		WatchInterval: viper.GetDuration("watch_interval"),
+		WatchDebounce: viper.GetDuration("watch_debounce"),
+	}
+	runnerDone := make(chan struct{})
+	go func() {
+		runner.Run(runnerCtx)
+		close(runnerDone)
+	}()
+
+	err = serve(globalContext, viper.GetDuration("drain_timeout"), servers...)
+	stopRunner()
+	<-runnerDone
+
+	// Give any webhooks for the last few jobs a chance to go out.
+	webhookCtx, cancelWebhooks := gocontext.WithTimeout(
+		gocontext.Background(),
+		webhookDrainTimeout,
+	)
+	globalContext.Webhooks.Close(webhookCtx)
+	cancelWebhooks()
+	shutdownTracing(gocontext.Background())
+	return err
+}
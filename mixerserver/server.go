@@ -0,0 +1,117 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	mixercontext "github.com/bieber/mixer/mixerserver/context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the HTTP servers until one fails or the process is asked
+// to stop with SIGINT or SIGTERM.  Either way it stops taking new
+// connections and mix jobs, and then waits up to drainTimeout for
+// in-flight requests and running jobs to finish before returning.
+// Servers with a TLSConfig serve HTTPS, the rest plain HTTP.
+func serve(
+	globalContext *mixercontext.GlobalContext,
+	drainTimeout time.Duration,
+	servers ...*http.Server,
+) error {
+	stop, cancelStop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer cancelStop()
+
+	serverErrs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				serverErrs <- server.ListenAndServeTLS("", "")
+			} else {
+				serverErrs <- server.ListenAndServe()
+			}
+		}(server)
+	}
+
+	// If a server fails, say because its port is taken, the rest are
+	// shut down and running jobs drained just as they would be on a
+	// signal, and then its error is returned.
+	var listenErr error
+	remaining := len(servers)
+	select {
+	case listenErr = <-serverErrs:
+		remaining--
+		globalContext.Logger.Error("server failed", "error", listenErr)
+	case <-stop.Done():
+	}
+
+	globalContext.Logger.Info(
+		"shutting down",
+		"drain_timeout", drainTimeout,
+	)
+	drainCtx, cancelDrain := context.WithTimeout(
+		context.Background(),
+		drainTimeout,
+	)
+	defer cancelDrain()
+
+	// Closing the job manager first means any submit that's still in
+	// flight gets turned away rather than starting a job we'd then
+	// have to wait on.
+	globalContext.Jobs.Close()
+
+	for _, server := range servers {
+		err := server.Shutdown(drainCtx)
+		if err != nil {
+			return err
+		}
+	}
+	for ; remaining > 0; remaining-- {
+		err := <-serverErrs
+		if !errors.Is(err, http.ErrServerClosed) && listenErr == nil {
+			listenErr = err
+		}
+	}
+
+	err := globalContext.Jobs.Wait(drainCtx)
+	if err != nil {
+		globalContext.Logger.Error(
+			"gave up waiting for running jobs",
+			"error", err,
+		)
+	}
+	if listenErr != nil {
+		return listenErr
+	}
+	if err != nil {
+		return err
+	}
+
+	globalContext.Logger.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	mixercontext "github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/jobs"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsAfterListenFailure(t *testing.T) {
+	// Hold a port so the first server can't listen on it.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	globalContext := &mixercontext.GlobalContext{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Jobs:   jobs.NewManager(),
+	}
+	release := make(chan struct{})
+	err = globalContext.Jobs.Start(
+		context.Background(),
+		func(context.Context) { <-release },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(
+			globalContext,
+			10*time.Second,
+			&http.Server{Addr: taken.Addr().String()},
+			&http.Server{Addr: "127.0.0.1:0"},
+		)
+	}()
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v before the running job finished", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if !globalContext.Jobs.Closed() {
+		t.Error("job manager still open after a server failed")
+	}
+
+	close(release)
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("serve succeeded, want the listen error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after the job finished")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package session implements the encrypted session tokens we hand to
+// clients in place of their raw Spotify credentials.  Each session
+// gets a random nonce and a fixed expiry when the user logs in, both
+// of which survive token refreshes, so a session can be revoked by
+// denying its nonce until it would have expired anyway.
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"sync"
+	"time"
+)
+
+// ErrExpired is returned when decoding a token whose session has
+// passed its expiry.
+var ErrExpired = errors.New("Session expired")
+
+// ErrRevoked is returned when decoding a token whose session has been
+// logged out.
+var ErrRevoked = errors.New("Session revoked")
+
+// Token is the decrypted contents of a session token.
+type Token struct {
+	spotify.AuthTokens
+	Nonce   string `json:"nonce"`
+	Expires int64  `json:"expires"`
+}
+
+// New starts a new session for the given auth tokens that will expire
+// after lifetime has elapsed.
+func New(authTokens spotify.AuthTokens, lifetime time.Duration) (Token, error) {
+	nonce, err := crypto.GenerateNonce()
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		AuthTokens: authTokens,
+		Nonce:      nonce,
+		Expires:    time.Now().Add(lifetime).Unix(),
+	}, nil
+}
+
+// Renew returns a copy of the token with refreshed auth tokens.  The
+// nonce and expiry carry over, since it's still the same session.
+func (t Token) Renew(authTokens spotify.AuthTokens) Token {
+	t.AuthTokens = authTokens
+	return t
+}
+
+// ExpiresAt returns the time at which the session expires.
+func (t Token) ExpiresAt() time.Time {
+	return time.Unix(t.Expires, 0)
+}
+
+// Encode encrypts the token for sending to the client.
+func (t Token) Encode() (string, error) {
+	jsonToken, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return crypto.Encrypt(string(jsonToken))
+}
+
+// Decode decrypts and parses a token from the client, and makes sure
+// it's complete and still valid.  A nil denyList skips the revocation
+// check.
+func Decode(token string, denyList *DenyList) (t Token, err error) {
+	decryptedToken, err := crypto.Decrypt(token)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal([]byte(decryptedToken), &t)
+	if err != nil {
+		return
+	}
+
+	if t.AccessToken == "" {
+		err = errors.New("Missing access token")
+		return
+	}
+	if t.RefreshToken == "" {
+		err = errors.New("Missing refresh token")
+		return
+	}
+	if t.Nonce == "" {
+		err = errors.New("Missing session nonce")
+		return
+	}
+	if time.Now().After(t.ExpiresAt()) {
+		err = ErrExpired
+		return
+	}
+	if denyList != nil {
+		var denied bool
+		denied, err = denyList.Denied(t)
+		if err != nil {
+			return
+		}
+		if denied {
+			err = ErrRevoked
+			return
+		}
+	}
+	return
+}
+
+// denyListBucket is the store bucket revoked sessions are kept in,
+// keyed by nonce.
+const denyListBucket = "revoked_sessions"
+
+// DenyList keeps track of revoked sessions until their natural
+// expiry.  Given a store, it keeps them there so revocations survive
+// restarts and are seen by every server sharing the store.  Otherwise
+// they're only kept in memory.  It is safe for concurrent use.
+type DenyList struct {
+	store   *store.Store
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewDenyList creates an empty DenyList, backed by st if it isn't
+// nil.
+func NewDenyList(st *store.Store) *DenyList {
+	return &DenyList{store: st, entries: map[string]time.Time{}}
+}
+
+// Deny revokes the session the token belongs to.
+func (d *DenyList) Deny(t Token) error {
+	if d.store != nil {
+		err := d.prune()
+		if err != nil {
+			return err
+		}
+		return d.store.Put(denyListBucket, t.Nonce, t.ExpiresAt())
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for nonce, expires := range d.entries {
+		if now.After(expires) {
+			delete(d.entries, nonce)
+		}
+	}
+	d.entries[t.Nonce] = t.ExpiresAt()
+	return nil
+}
+
+// Denied checks whether the session the token belongs to has been
+// revoked.
+func (d *DenyList) Denied(t Token) (bool, error) {
+	if d.store != nil {
+		var expires time.Time
+		err := d.store.Get(denyListBucket, t.Nonce, &expires)
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, ok := d.entries[t.Nonce]
+	return ok, nil
+}
+
+// prune drops any stored entries for sessions that would have expired
+// on their own by now.
+func (d *DenyList) prune() error {
+	now := time.Now()
+	return d.store.DeleteIf(
+		denyListBucket,
+		"",
+		func(key string, value []byte) bool {
+			var expires time.Time
+			err := json.Unmarshal(value, &expires)
+			return err != nil || now.After(expires)
+		},
+	)
+}
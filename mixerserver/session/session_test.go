@@ -0,0 +1,154 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package session
+
+import (
+	"errors"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/spotify"
+	"github.com/bieber/mixer/mixerserver/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newToken(t *testing.T, lifetime time.Duration) Token {
+	token, err := New(
+		spotify.AuthTokens{AccessToken: "access", RefreshToken: "refresh"},
+		lifetime,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDenyList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	st, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		denyList *DenyList
+	}{
+		{"memory", NewDenyList(nil)},
+		{"store", NewDenyList(st)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			denied := newToken(t, time.Hour)
+			allowed := newToken(t, time.Hour)
+
+			err := test.denyList.Deny(denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := test.denyList.Denied(denied); !ok || err != nil {
+				t.Errorf("Denied(denied) = %v, %v", ok, err)
+			}
+			if ok, err := test.denyList.Denied(allowed); ok || err != nil {
+				t.Errorf("Denied(allowed) = %v, %v", ok, err)
+			}
+		})
+	}
+
+	// A new DenyList on the same store, as after a restart, should
+	// still know about the revocation.
+	denied := newToken(t, time.Hour)
+	err = NewDenyList(st).Deny(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	st, err = store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if ok, err := NewDenyList(st).Denied(denied); !ok || err != nil {
+		t.Errorf("revocation lost on reopen: %v, %v", ok, err)
+	}
+}
+
+func TestDenyListPrunesExpired(t *testing.T) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	denyList := NewDenyList(st)
+
+	expired := newToken(t, -time.Minute)
+	live := newToken(t, time.Hour)
+	for _, token := range []Token{expired, live} {
+		err := denyList.Deny(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pruning happens on the way into Deny, so the expired entry
+	// goes the next time.
+	err = denyList.Deny(newToken(t, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expires time.Time
+	err = st.Get(denyListBucket, expired.Nonce, &expires)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expired entry still stored: %v", err)
+	}
+	if ok, _ := denyList.Denied(live); !ok {
+		t.Error("live entry was pruned")
+	}
+}
+
+func TestDecodeRevoked(t *testing.T) {
+	key, err := crypto.GenerateAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = crypto.SetAESKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := newToken(t, time.Hour)
+	encoded, err := token.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denyList := NewDenyList(nil)
+	if _, err := Decode(encoded, denyList); err != nil {
+		t.Fatalf("Decode before logout: %v", err)
+	}
+	err = denyList.Deny(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(encoded, denyList); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Decode after logout = %v, want ErrRevoked", err)
+	}
+}
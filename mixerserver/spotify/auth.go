@@ -20,6 +20,9 @@
 package spotify
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -32,38 +35,71 @@ import (
 // AuthTokens stores information about (and accepts JSON requests for)
 // Spotify API access tokens.  The AccessToken is used to access the
 // API endpoints, the RefreshToken to get a new token after ExpiresIn
-// seconds have elapsed.
+// seconds have elapsed.  Scope is the space-separated list of scopes
+// the user actually granted, which may differ from what we asked for.
 type AuthTokens struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+// codeVerifierLength is the number of random bytes in a PKCE code
+// verifier.  Encoded as unpadded base64 this comes out to 86
+// characters, comfortably inside the 43-128 range RFC 7636 allows.
+const codeVerifierLength = 64
+
+// GenerateCodeVerifier generates a new random PKCE code verifier.  It
+// should be kept secret until it's sent along with the authorization
+// code to GetAuthTokens.
+func GenerateCodeVerifier() (string, error) {
+	verifierBytes := make([]byte, codeVerifierLength)
+	_, err := rand.Read(verifierBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(verifierBytes), nil
+}
+
+// CodeChallenge computes the S256 PKCE code challenge for a code
+// verifier.
+func CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
 
 // GetLoginURI generates a login URI you can direct a user to to
-// authenticate the Spotify API.
+// authenticate the Spotify API.  If codeVerifier is non-empty, the
+// URI will request the PKCE flow and the same verifier must be passed
+// to GetAuthTokens.  Spotify replaces any earlier grant with the
+// requested scopes, so when asking for additional consent, scopes
+// should include the ones the user has already granted.
 func GetLoginURI(
 	clientID string,
 	csrfToken string,
+	codeVerifier string,
+	scopes []string,
 	redirectURI *url.URL,
 ) (*url.URL, error) {
-	scopes := []string{
-		"playlist-read-private",
-		"playlist-read-collaborative",
-		"playlist-modify-public",
-		"playlist-modify-private",
-	}
+	scopes = mergeScopes(scopes)
 
 	loginURI, err := url.Parse("https://accounts.spotify.com/authorize/")
 	if err != nil {
 		return nil, err
 	}
-	loginURI.RawQuery = url.Values{
+	query := url.Values{
 		"client_id":     []string{clientID},
 		"response_type": []string{"code"},
 		"state":         []string{csrfToken},
 		"scope":         []string{strings.Join(scopes, " ")},
 		"redirect_uri":  []string{redirectURI.String()},
-	}.Encode()
+	}
+	if codeVerifier != "" {
+		query.Set("code_challenge_method", "S256")
+		query.Set("code_challenge", CodeChallenge(codeVerifier))
+	}
+	loginURI.RawQuery = query.Encode()
 
 	return loginURI, nil
 }
@@ -72,36 +108,66 @@ func GetLoginURI(
 // given an access code returned in the redirect from the login page
 // (or a refresh token).  redirectURI is required to authenticate the
 // request, and should be exactly the same as the redirect_uri that
-// was initially sent to Spotify.
+// was initially sent to Spotify.  codeVerifier should be the PKCE
+// verifier the login URI was generated with, if any.  If clientSecret
+// is empty the request is made as a public client, in which case the
+// PKCE verifier is mandatory.
 func GetAuthTokens(
+	ctx context.Context,
 	clientID string,
 	clientSecret string,
 	code string,
+	codeVerifier string,
 	redirectURI *url.URL,
 ) (out AuthTokens, err error) {
-	response, err := http.PostForm(
+	if clientSecret == "" && codeVerifier == "" {
+		err = errors.New("A client secret or PKCE verifier is required")
+		return
+	}
+
+	form := url.Values{
+		"grant_type":   []string{"authorization_code"},
+		"code":         []string{code},
+		"redirect_uri": []string{redirectURI.String()},
+		"client_id":    []string{clientID},
+	}
+	if clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+
+	request, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
 		"https://accounts.spotify.com/api/token",
-		url.Values{
-			"grant_type":    []string{"authorization_code"},
-			"code":          []string{code},
-			"redirect_uri":  []string{redirectURI.String()},
-			"client_id":     []string{clientID},
-			"client_secret": []string{clientSecret},
-		},
+		strings.NewReader(form.Encode()),
 	)
 	if err != nil {
 		return
 	}
+	request.Header.Set("Content-type", "application/x-www-form-urlencoded")
+
+	response, err := do("token", request)
+	if err != nil {
+		return
+	}
 	defer response.Body.Close()
+	err = checkResponse(response)
+	if err != nil {
+		return
+	}
 
 	err = json.NewDecoder(response.Body).Decode(&out)
-	response.Body.Close()
 	return
 }
 
 // RefreshAuthTokens fetches authentication tokens from the Spotify
-// server to refresh stale ones.
+// server to refresh stale ones.  As with GetAuthTokens, an empty
+// clientSecret refreshes as a public (PKCE) client.
 func RefreshAuthTokens(
+	ctx context.Context,
 	authTokens AuthTokens,
 	clientID string,
 	clientSecret string,
@@ -111,56 +177,68 @@ func RefreshAuthTokens(
 		return
 	}
 
-	body := strings.NewReader(
-		url.Values{
-			"grant_type":    []string{"refresh_token"},
-			"refresh_token": []string{authTokens.RefreshToken},
-		}.Encode(),
-	)
+	form := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{authTokens.RefreshToken},
+	}
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+	body := strings.NewReader(form.Encode())
 
-	client := &http.Client{}
-	request, err := http.NewRequest("POST", uri.String(), body)
+	request, err := http.NewRequestWithContext(ctx, "POST", uri.String(), body)
 	if err != nil {
 		return
 	}
-	request.Header.Set(
-		"Authorization",
-		""+
-			"Basic "+
-			base64.URLEncoding.EncodeToString(
-				[]byte(clientID+":"+clientSecret),
-			),
-	)
+	if clientSecret != "" {
+		request.Header.Set(
+			"Authorization",
+			""+
+				"Basic "+
+				base64.URLEncoding.EncodeToString(
+					[]byte(clientID+":"+clientSecret),
+				),
+		)
+	}
 	request.Header.Set("Content-type", "application/x-www-form-urlencoded")
 
-	response, err := client.Do(request)
+	response, err := do("token", request)
 	if err != nil {
 		return
 	}
-	if response.StatusCode != http.StatusOK {
-		err = errors.New(response.Status)
-	}
 	defer response.Body.Close()
+	err = checkResponse(response)
+	if err != nil {
+		return
+	}
 
 	err = json.NewDecoder(response.Body).Decode(&out)
 	if err != nil {
 		return
 	}
 
-	out.RefreshToken = authTokens.RefreshToken
+	// Spotify rotates refresh tokens for PKCE clients, but leaves
+	// the old one in place (and out of the response) otherwise.
+	if out.RefreshToken == "" {
+		out.RefreshToken = authTokens.RefreshToken
+	}
+	if out.Scope == "" {
+		out.Scope = authTokens.Scope
+	}
 	return
 }
 
 // NewAuthenticatedRequest returns a new *http.Request with the
 // authentication headers set for the Spotify API.  Aside from the
-// authTokens argument, it is equivalent to http.NewRequest.
+// authTokens argument, it is equivalent to http.NewRequestWithContext.
 func NewAuthenticatedRequest(
+	ctx context.Context,
 	authTokens AuthTokens,
 	method string,
 	uri *url.URL,
 	body io.Reader,
 ) (request *http.Request, err error) {
-	request, err = http.NewRequest(method, uri.String(), body)
+	request, err = http.NewRequestWithContext(ctx, method, uri.String(), body)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"context"
+	"github.com/bieber/mixer/mixerserver/metrics"
+	"github.com/bieber/mixer/mixerserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetries is the number of times a request will be retried after
+// a transient failure before giving up and returning the error
+// response.
+const maxRetries = 3
+
+// maxRetryDelay caps how long we'll wait between retries, even if
+// Spotify's Retry-After header asks for longer.
+const maxRetryDelay = time.Minute
+
+var client = &http.Client{}
+
+type retryLimitKey struct{}
+
+// WithRetryLimit returns a context under which requests spend at most
+// limit in total waiting to retry.  A request that would have to wait
+// any longer gives up and returns Spotify's error response instead,
+// so code serving a person can tell them to come back later rather
+// than leaving them hanging.
+func WithRetryLimit(
+	ctx context.Context,
+	limit time.Duration,
+) context.Context {
+	return context.WithValue(ctx, retryLimitKey{}, limit)
+}
+
+// retryLimit returns the total time requests under ctx may spend
+// waiting to retry.
+func retryLimit(ctx context.Context) time.Duration {
+	if limit, ok := ctx.Value(retryLimitKey{}).(time.Duration); ok {
+		return limit
+	}
+	return maxRetries * maxRetryDelay
+}
+
+// do sends a request to the Spotify API, recording metrics and a
+// trace span under the given endpoint name.  Requests that get rate
+// limited, or idempotent ones that hit a temporary server error, are
+// retried after the delay Spotify asks for (or with exponential
+// backoff if it doesn't say), as long as their body can be replayed
+// and the wait fits within the context's retry limit.
+func do(endpoint string, request *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Tracer.Start(
+		request.Context(),
+		"spotify "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", request.Method),
+			attribute.String("spotify.endpoint", endpoint),
+		),
+	)
+	defer span.End()
+	request = request.WithContext(ctx)
+
+	limit := retryLimit(ctx)
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		t0 := time.Now()
+		response, err := client.Do(request)
+		metrics.SpotifyDuration.WithLabelValues(endpoint, request.Method).
+			Observe(time.Now().Sub(t0).Seconds())
+		if err != nil {
+			metrics.SpotifyRequests.WithLabelValues(
+				endpoint,
+				request.Method,
+				"error",
+			).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		metrics.SpotifyRequests.WithLabelValues(
+			endpoint,
+			request.Method,
+			strconv.Itoa(response.StatusCode),
+		).Inc()
+		span.SetAttributes(
+			attribute.Int("http.status_code", response.StatusCode),
+			attribute.Int("spotify.retries", attempt),
+		)
+
+		if attempt >= maxRetries ||
+			!retryable(request.Method, response.StatusCode) ||
+			(request.Body != nil && request.GetBody == nil) {
+			if response.StatusCode >= http.StatusBadRequest {
+				span.SetStatus(codes.Error, response.Status)
+			}
+			return response, nil
+		}
+
+		delay := retryDelay(response, attempt)
+		if waited+delay > limit {
+			span.SetStatus(codes.Error, response.Status)
+			return response, nil
+		}
+		waited += delay
+		span.AddEvent(
+			"retry",
+			trace.WithAttributes(
+				attribute.Int("http.status_code", response.StatusCode),
+				attribute.String("delay", delay.String()),
+			),
+		)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if request.GetBody != nil {
+			request.Body, err = request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		metrics.SpotifyRetries.WithLabelValues(endpoint, request.Method).Inc()
+	}
+}
+
+// retryable checks whether a response status is worth retrying.  A
+// rate limited request was never processed, so it's always safe to
+// retry.  A gateway error may come after Spotify has already acted on
+// the request though, so only idempotent methods are retried then,
+// and a POST adding tracks can't add them twice.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		switch method {
+		case "GET", "HEAD", "PUT", "DELETE":
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay works out how long to wait before retrying a request.
+func retryDelay(response *http.Response, attempt int) time.Duration {
+	delay := 500 * time.Millisecond << attempt
+	retryAfter := response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
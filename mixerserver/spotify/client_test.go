@@ -0,0 +1,128 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package spotify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubAPI points the Spotify client at handler for the rest of the
+// test.
+func stubAPI(t *testing.T, handler http.HandlerFunc) {
+	t.Cleanup(StubAPI(handler))
+}
+
+func TestRetryLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		requests   int
+		status     int
+	}{
+		{"short wait is retried", "0", 2, http.StatusOK},
+		{"long wait gives up", "30", 1, http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Header().Set("Retry-After", test.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			})
+
+			ctx := WithRetryLimit(context.Background(), time.Second)
+			request, err := http.NewRequestWithContext(
+				ctx,
+				"GET",
+				"https://api.spotify.com/v1/me",
+				nil,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := do("me", request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != test.status {
+				t.Errorf("status %d, want %d", response.StatusCode, test.status)
+			}
+			if requests != test.requests {
+				t.Errorf("%d requests, want %d", requests, test.requests)
+			}
+		})
+	}
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	tests := []struct {
+		method   string
+		status   int
+		requests int
+	}{
+		{"GET", http.StatusBadGateway, 2},
+		{"DELETE", http.StatusServiceUnavailable, 2},
+		{"POST", http.StatusBadGateway, 1},
+		{"POST", http.StatusGatewayTimeout, 1},
+		{"POST", http.StatusTooManyRequests, 2},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprint(test.method, " ", test.status)
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(test.status)
+				}
+			})
+
+			request, err := http.NewRequest(
+				test.method,
+				"https://api.spotify.com/v1/me",
+				strings.NewReader("{}"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := do("me", request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if requests != test.requests {
+				t.Errorf("%d requests, want %d", requests, test.requests)
+			}
+		})
+	}
+}
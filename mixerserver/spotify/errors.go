@@ -0,0 +1,93 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is returned when the Spotify API responds with an error
+// status.  Message is whatever explanation Spotify gave, if any.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long Spotify asked us to wait before trying
+	// again, for rate limited requests.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf(
+			"Spotify API error: %d %s",
+			e.StatusCode,
+			http.StatusText(e.StatusCode),
+		)
+	}
+	return fmt.Sprintf("Spotify API error: %d %s", e.StatusCode, e.Message)
+}
+
+// checkResponse returns an *Error if the response's status isn't one
+// of the expected ones, or http.StatusOK if none are given.  The
+// response body is consumed in that case, but not closed.
+func checkResponse(response *http.Response, expected ...int) error {
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+	for _, status := range expected {
+		if response.StatusCode == status {
+			return nil
+		}
+	}
+
+	out := &Error{StatusCode: response.StatusCode}
+	retryAfter := response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		out.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	// The Web API wraps its errors in an object, while the accounts
+	// service uses the OAuth style of a bare string plus description.
+	body, _ := io.ReadAll(response.Body)
+	apiError := struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	oauthError := struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{}
+	if json.Unmarshal(body, &apiError) == nil {
+		out.Message = apiError.Error.Message
+	} else if json.Unmarshal(body, &oauthError) == nil {
+		out.Message = oauthError.Error
+		if oauthError.Description != "" {
+			out.Message += ": " + oauthError.Description
+		}
+	}
+
+	return out
+}
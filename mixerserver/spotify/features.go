@@ -0,0 +1,189 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const audioFeatureBatchSize = 100
+
+// maxCachedFeatures caps how many tracks' audio features we hold on
+// to.  Once the cache fills up it's emptied and starts over, which is
+// crude but keeps memory bounded without any bookkeeping.  It's a
+// variable so tests can lower it.
+var maxCachedFeatures = 100000
+
+// ErrAudioFeaturesUnavailable is returned when Spotify won't give us
+// audio features at all.  Spotify stopped serving them to apps
+// registered after 27 November 2024, answering 403 instead, so audio
+// feature filters only work with older client IDs or ones Spotify has
+// granted extended access.
+var ErrAudioFeaturesUnavailable = errors.New(
+	"Spotify doesn't provide audio features to this app, " +
+		"so tempo, energy, danceability, valence, acousticness and " +
+		"instrumentalness filters can't be used",
+)
+
+// AudioFeatures describes how a track sounds.  Tempo is in beats per
+// minute, and the rest run from 0 to 1.
+type AudioFeatures struct {
+	ID               string  `json:"id"`
+	Tempo            float64 `json:"tempo"`
+	Energy           float64 `json:"energy"`
+	Danceability     float64 `json:"danceability"`
+	Valence          float64 `json:"valence"`
+	Acousticness     float64 `json:"acousticness"`
+	Instrumentalness float64 `json:"instrumentalness"`
+}
+
+// featureCache remembers the audio features we've already fetched,
+// since they never change for a given track.  Tracks Spotify has no
+// features for are cached as nil so we don't keep asking.
+var featureCache = struct {
+	sync.Mutex
+	features map[string]*AudioFeatures
+}{features: map[string]*AudioFeatures{}}
+
+// GetAudioFeatures fetches the audio features of the given tracks,
+// keyed by track ID.  Tracks Spotify has no features for, such as
+// local files, are left out of the result.  Features are cached, so
+// only tracks we haven't seen before are fetched, 100 at a time.  If
+// Spotify refuses to share audio features with this app, it returns
+// ErrAudioFeaturesUnavailable.
+func GetAudioFeatures(
+	ctx context.Context,
+	authTokens AuthTokens,
+	trackIDs []string,
+) (map[string]AudioFeatures, error) {
+	features := map[string]AudioFeatures{}
+	missing := []string{}
+
+	seen := map[string]bool{}
+	featureCache.Lock()
+	for _, id := range trackIDs {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		cached, ok := featureCache.features[id]
+		switch {
+		case !ok:
+			missing = append(missing, id)
+		case cached != nil:
+			features[id] = *cached
+		}
+	}
+	featureCache.Unlock()
+
+	for start := 0; start < len(missing); start += audioFeatureBatchSize {
+		end := start + audioFeatureBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch, err := getAudioFeatureBatch(ctx, authTokens, missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		featureCache.Lock()
+		if len(featureCache.features)+len(batch) > maxCachedFeatures {
+			featureCache.features = map[string]*AudioFeatures{}
+		}
+		for _, id := range missing[start:end] {
+			trackFeatures, ok := batch[id]
+			if !ok {
+				featureCache.features[id] = nil
+				continue
+			}
+			features[id] = trackFeatures
+			featureCache.features[id] = &trackFeatures
+		}
+		featureCache.Unlock()
+	}
+
+	return features, nil
+}
+
+// getAudioFeatureBatch fetches the audio features of up to 100 tracks
+// in a single request.
+func getAudioFeatureBatch(
+	ctx context.Context,
+	authTokens AuthTokens,
+	trackIDs []string,
+) (features map[string]AudioFeatures, err error) {
+	fetchURI, err := url.Parse("https://api.spotify.com/v1/audio-features")
+	if err != nil {
+		return
+	}
+	fetchURI.RawQuery = url.Values{
+		"ids": []string{strings.Join(trackIDs, ",")},
+	}.Encode()
+
+	var request *http.Request
+	request, err = NewAuthenticatedRequest(
+		ctx,
+		authTokens,
+		"GET",
+		fetchURI,
+		nil,
+	)
+	if err != nil {
+		return
+	}
+
+	response, err := do("audio_features", request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	err = checkResponse(response)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+		err = fmt.Errorf("%w (%w)", ErrAudioFeaturesUnavailable, err)
+		return
+	} else if err != nil {
+		return
+	}
+
+	// Spotify sends null in place of any track it has no features
+	// for.
+	result := struct {
+		AudioFeatures []*AudioFeatures `json:"audio_features"`
+	}{}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return
+	}
+
+	features = map[string]AudioFeatures{}
+	for _, trackFeatures := range result.AudioFeatures {
+		if trackFeatures != nil {
+			features[trackFeatures.ID] = *trackFeatures
+		}
+	}
+	return
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubAudioFeatures points the Spotify client at a fake audio
+// features endpoint with an empty cache, and returns the IDs asked
+// for in each request it gets.  Tracks whose IDs start with "local"
+// have no features.
+func stubAudioFeatures(t *testing.T) *[][]string {
+	features := featureCache.features
+	featureCache.features = map[string]*AudioFeatures{}
+	t.Cleanup(func() { featureCache.features = features })
+
+	requests := [][]string{}
+	stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/audio-features" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		ids := strings.Split(r.URL.Query().Get("ids"), ",")
+		requests = append(requests, ids)
+
+		result := []*AudioFeatures{}
+		for _, id := range ids {
+			if strings.HasPrefix(id, "local") {
+				result = append(result, nil)
+			} else {
+				result = append(result, &AudioFeatures{ID: id, Tempo: 120})
+			}
+		}
+		json.NewEncoder(w).Encode(
+			map[string][]*AudioFeatures{"audio_features": result},
+		)
+	})
+	return &requests
+}
+
+func getAudioFeatures(t *testing.T, ids ...string) map[string]AudioFeatures {
+	t.Helper()
+	features, err := GetAudioFeatures(
+		context.Background(),
+		AuthTokens{AccessToken: "token"},
+		ids,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return features
+}
+
+func TestGetAudioFeaturesBatches(t *testing.T) {
+	requests := stubAudioFeatures(t)
+
+	ids := []string{"", "track0"}
+	for i := 0; i < 250; i++ {
+		ids = append(ids, fmt.Sprint("track", i))
+	}
+	features := getAudioFeatures(t, ids...)
+
+	if len(features) != 250 {
+		t.Errorf("got features for %d tracks, want 250", len(features))
+	}
+	sizes := []int{}
+	for _, request := range *requests {
+		sizes = append(sizes, len(request))
+	}
+	if fmt.Sprint(sizes) != "[100 100 50]" {
+		t.Errorf("got batches of %v, want [100 100 50]", sizes)
+	}
+}
+
+func TestGetAudioFeaturesCachesMissing(t *testing.T) {
+	requests := stubAudioFeatures(t)
+
+	features := getAudioFeatures(t, "track", "local")
+	if _, ok := features["local"]; ok || len(features) != 1 {
+		t.Errorf("got features %v, want only track's", features)
+	}
+
+	features = getAudioFeatures(t, "track", "local")
+	if len(*requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(*requests))
+	}
+	if features["track"].Tempo != 120 || len(features) != 1 {
+		t.Errorf("got cached features %v, want only track's", features)
+	}
+}
+
+func TestGetAudioFeaturesCacheReset(t *testing.T) {
+	requests := stubAudioFeatures(t)
+	limit := maxCachedFeatures
+	maxCachedFeatures = 3
+	defer func() { maxCachedFeatures = limit }()
+
+	getAudioFeatures(t, "a", "b")
+	// Caching these would go over the limit, so the cache is emptied
+	// first.
+	getAudioFeatures(t, "c", "d")
+	if len(featureCache.features) != 2 {
+		t.Errorf("cache holds %d tracks, want 2", len(featureCache.features))
+	}
+
+	*requests = nil
+	getAudioFeatures(t, "a", "c")
+	if fmt.Sprint(*requests) != "[[a]]" {
+		t.Errorf("got requests %v, want [[a]]", *requests)
+	}
+}
+
+func TestGetAudioFeaturesForbidden(t *testing.T) {
+	stubAudioFeatures(t)
+	stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	_, err := GetAudioFeatures(
+		context.Background(),
+		AuthTokens{AccessToken: "token"},
+		[]string{"track"},
+	)
+	if !errors.Is(err, ErrAudioFeaturesUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrAudioFeaturesUnavailable)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 403 {
+		t.Errorf("got %v, want it to wrap the 403", err)
+	}
+	if _, ok := featureCache.features["track"]; ok {
+		t.Error("track cached after a failed request")
+	}
+}
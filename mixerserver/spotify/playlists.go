@@ -21,9 +21,8 @@ package spotify
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
-	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -39,18 +38,70 @@ type Playlist struct {
 	Name          string `json:"name"`
 	Collaborative bool   `json:"collaborative"`
 	Public        bool   `json:"public"`
+	SnapshotID    string `json:"snapshot_id"`
 	Owner         struct {
 		ID string `json:"id"`
 	} `json:"owner"`
 }
 
+// GetPlaylist fetches the details of a single playlist.
+func GetPlaylist(
+	ctx context.Context,
+	authTokens AuthTokens,
+	playlistID string,
+) (playlist Playlist, err error) {
+	fetchURI, err := url.Parse(
+		"https://api.spotify.com/v1/playlists/" + url.PathEscape(playlistID),
+	)
+	if err != nil {
+		return
+	}
+	fetchURI.RawQuery = url.Values{
+		"fields": []string{"id,name,collaborative,public,snapshot_id,owner(id)"},
+	}.Encode()
+
+	request, err := NewAuthenticatedRequest(
+		ctx,
+		authTokens,
+		"GET",
+		fetchURI,
+		nil,
+	)
+	if err != nil {
+		return
+	}
+
+	response, err := do("playlist", request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	err = checkResponse(response)
+	if err != nil {
+		return
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&playlist)
+	return
+}
+
 // GetPlaylists fetches all the playlists of the given user.
 func GetPlaylists(
+	ctx context.Context,
 	authTokens AuthTokens,
 	userID string,
 ) (playlists []Playlist, err error) {
 	playlists = []Playlist{}
 
+	err = requireScopes(
+		authTokens,
+		ScopePlaylistReadPrivate,
+		ScopePlaylistReadCollaborative,
+	)
+	if err != nil {
+		return
+	}
+
 	fetchURI, err := url.Parse(
 		"https://api.spotify.com/v1/users/" + userID + "/playlists",
 	)
@@ -58,7 +109,6 @@ func GetPlaylists(
 		return
 	}
 
-	client := &http.Client{}
 	var request *http.Request
 	var response *http.Response
 	for batch := 0; true; batch++ {
@@ -67,16 +117,26 @@ func GetPlaylists(
 			"limit":  []string{strconv.Itoa(playlistBatchSize)},
 		}.Encode()
 
-		request, err = NewAuthenticatedRequest(authTokens, "GET", fetchURI, nil)
+		request, err = NewAuthenticatedRequest(
+			ctx,
+			authTokens,
+			"GET",
+			fetchURI,
+			nil,
+		)
 		if err != nil {
 			return
 		}
 
-		response, err = client.Do(request)
+		response, err = do("playlists", request)
 		if err != nil {
 			return
 		}
 		defer response.Body.Close()
+		err = checkResponse(response)
+		if err != nil {
+			return
+		}
 
 		result := struct {
 			Playlists []Playlist `json:"items"`
@@ -101,11 +161,56 @@ func GetPlaylists(
 // someone adds or removes tracks in between batches, but that's not a
 // serious enough issue to bother with for now.
 func GetPlaylistTrackIDs(
+	ctx context.Context,
 	authTokens AuthTokens,
 	userID string,
 	playlistID string,
 ) (trackIDs []string, err error) {
+	tracks, err := getPlaylistTracks(ctx, authTokens, userID, playlistID, "id")
+	if err != nil {
+		return nil, err
+	}
+
 	trackIDs = []string{}
+	for _, track := range tracks {
+		trackIDs = append(trackIDs, track.ID)
+	}
+	return trackIDs, nil
+}
+
+// GetPlaylistTracks returns all the tracks in the given playlist,
+// along with their metadata.  The same caveat about inconsistency
+// applies as for GetPlaylistTrackIDs.
+func GetPlaylistTracks(
+	ctx context.Context,
+	authTokens AuthTokens,
+	userID string,
+	playlistID string,
+) ([]Track, error) {
+	return getPlaylistTracks(ctx, authTokens, userID, playlistID, trackFields)
+}
+
+// getPlaylistTracks fetches the tracks in a playlist, with only the
+// given fields of each track filled in.
+func getPlaylistTracks(
+	ctx context.Context,
+	authTokens AuthTokens,
+	userID string,
+	playlistID string,
+	fields string,
+) (tracks []Track, err error) {
+	tracks = []Track{}
+
+	err = requirePlaylistScope(
+		ctx,
+		authTokens,
+		playlistID,
+		"",
+		ScopePlaylistReadPrivate,
+	)
+	if err != nil {
+		return
+	}
 
 	fetchURI, err := url.Parse("" +
 		"https://api.spotify.com/v1/users/" +
@@ -118,32 +223,39 @@ func GetPlaylistTrackIDs(
 		return
 	}
 
-	client := &http.Client{}
 	var request *http.Request
 	var response *http.Response
 	for batch := 0; true; batch++ {
 		fetchURI.RawQuery = url.Values{
 			"offset": []string{strconv.Itoa(batch * trackFetchBatchSize)},
 			"limit":  []string{strconv.Itoa(trackFetchBatchSize)},
-			"fields": []string{"items(track(id)),next"},
+			"fields": []string{"items(track(" + fields + ")),next"},
 		}.Encode()
 
-		request, err = NewAuthenticatedRequest(authTokens, "GET", fetchURI, nil)
+		request, err = NewAuthenticatedRequest(
+			ctx,
+			authTokens,
+			"GET",
+			fetchURI,
+			nil,
+		)
 		if err != nil {
 			return
 		}
 
-		response, err = client.Do(request)
+		response, err = do("playlist_tracks", request)
 		if err != nil {
 			return
 		}
 		defer response.Body.Close()
+		err = checkResponse(response)
+		if err != nil {
+			return
+		}
 
 		result := struct {
 			Tracks []struct {
-				Track struct {
-					ID string `json:"id"`
-				} `json:"track"`
+				Track Track `json:"track"`
 			} `json:"items"`
 			Next string `json:"next"`
 		}{}
@@ -152,8 +264,8 @@ func GetPlaylistTrackIDs(
 			return
 		}
 
-		for _, track := range result.Tracks {
-			trackIDs = append(trackIDs, track.Track.ID)
+		for _, item := range result.Tracks {
+			tracks = append(tracks, item.Track)
 		}
 
 		if result.Next == "" {
@@ -167,12 +279,25 @@ func GetPlaylistTrackIDs(
 // WritePlaylist deletes all the existing tracks in the given playlist
 // and replaces them with the specified contents.
 func WritePlaylist(
+	ctx context.Context,
 	authTokens AuthTokens,
 	destListOwnerID string,
 	destListID string,
 	trackIDs []string,
 ) error {
+	err := requirePlaylistScope(
+		ctx,
+		authTokens,
+		destListID,
+		ScopePlaylistModifyPublic,
+		ScopePlaylistModifyPrivate,
+	)
+	if err != nil {
+		return err
+	}
+
 	destListTrackIDs, err := GetPlaylistTrackIDs(
+		ctx,
 		authTokens,
 		destListOwnerID,
 		destListID,
@@ -208,7 +333,6 @@ func WritePlaylist(
 		return err
 	}
 
-	client := &http.Client{}
 	for batch := 0; batch < deleteBatches; batch++ {
 		data := map[string][]map[string]string{
 			"tracks": []map[string]string{},
@@ -233,6 +357,7 @@ func WritePlaylist(
 		}
 
 		request, err := NewAuthenticatedRequest(
+			ctx,
 			authTokens,
 			"DELETE",
 			deleteURI,
@@ -242,14 +367,15 @@ func WritePlaylist(
 			return err
 		}
 
-		response, err := client.Do(request)
+		response, err := do("playlist_tracks", request)
 		if err != nil {
 			return err
 		}
-		if response.StatusCode != http.StatusOK {
-			return errors.New(response.Status)
-		}
+		err = checkResponse(response)
 		response.Body.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	writeBatches := len(trackIDs) / trackWriteBatchSize
@@ -287,6 +413,7 @@ func WritePlaylist(
 		}
 
 		request, err := NewAuthenticatedRequest(
+			ctx,
 			authTokens,
 			"POST",
 			writeURI,
@@ -296,16 +423,15 @@ func WritePlaylist(
 			return err
 		}
 
-		response, err := client.Do(request)
+		response, err := do("playlist_tracks", request)
 		if err != nil {
 			return err
 		}
-		if response.StatusCode != http.StatusCreated &&
-			response.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(response.Body)
-			return errors.New(response.Status + ": " + string(body))
-		}
+		err = checkResponse(response, http.StatusCreated, http.StatusOK)
 		response.Body.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// OAuth scopes used by the various parts of the mixer.
+const (
+	ScopePlaylistReadPrivate       = "playlist-read-private"
+	ScopePlaylistReadCollaborative = "playlist-read-collaborative"
+	ScopePlaylistModifyPublic      = "playlist-modify-public"
+	ScopePlaylistModifyPrivate     = "playlist-modify-private"
+	ScopeUserLibraryRead           = "user-library-read"
+	ScopeUserTopRead               = "user-top-read"
+)
+
+// KnownScopes lists every OAuth scope the Spotify Web API defines.
+var KnownScopes = []string{
+	"app-remote-control",
+	"playlist-modify-private",
+	"playlist-modify-public",
+	"playlist-read-collaborative",
+	"playlist-read-private",
+	"streaming",
+	"ugc-image-upload",
+	"user-follow-modify",
+	"user-follow-read",
+	"user-library-modify",
+	"user-library-read",
+	"user-modify-playback-state",
+	"user-read-currently-playing",
+	"user-read-email",
+	"user-read-playback-position",
+	"user-read-playback-state",
+	"user-read-private",
+	"user-read-recently-played",
+	"user-top-read",
+}
+
+// Feature names a piece of functionality that needs its own set of
+// OAuth scopes.  Users are only asked to consent to a feature's
+// scopes once they actually try to use it.
+type Feature string
+
+// Features the server knows how to request scopes for.
+const (
+	FeaturePlaylists Feature = "playlists"
+	FeatureMix       Feature = "mix"
+	FeatureLibrary   Feature = "library"
+	FeatureTopTracks Feature = "top_tracks"
+)
+
+// legacyScopes are the scopes every login asked for before they were
+// configurable.  Tokens issued back then don't record a scope at all,
+// so they're taken to have been granted these.
+var legacyScopes = []string{
+	ScopePlaylistReadPrivate,
+	ScopePlaylistReadCollaborative,
+	ScopePlaylistModifyPublic,
+	ScopePlaylistModifyPrivate,
+}
+
+// FeatureScopes maps each feature to the scopes it requires.
+type FeatureScopes map[Feature][]string
+
+// DefaultFeatureScopes returns the scopes each feature requires out
+// of the box.  The result is a fresh copy, so it's safe to modify.
+func DefaultFeatureScopes() FeatureScopes {
+	return FeatureScopes{
+		FeaturePlaylists: []string{
+			ScopePlaylistReadPrivate,
+			ScopePlaylistReadCollaborative,
+		},
+		FeatureMix: []string{
+			ScopePlaylistReadPrivate,
+			ScopePlaylistReadCollaborative,
+			ScopePlaylistModifyPublic,
+			ScopePlaylistModifyPrivate,
+		},
+		FeatureLibrary:   []string{ScopeUserLibraryRead},
+		FeatureTopTracks: []string{ScopeUserTopRead},
+	}
+}
+
+// For returns the sorted union of the scopes required by all the
+// given features.
+func (fs FeatureScopes) For(features ...Feature) []string {
+	scopes := []string{}
+	for _, feature := range features {
+		scopes = append(scopes, fs[feature]...)
+	}
+	return mergeScopes(scopes)
+}
+
+// Scopes returns the list of scopes the tokens were granted.  Tokens
+// with no scope recorded predate configurable scopes, and get the
+// fixed set every login asked for then.
+func (a AuthTokens) Scopes() []string {
+	if strings.TrimSpace(a.Scope) == "" {
+		return append([]string{}, legacyScopes...)
+	}
+	return strings.Fields(a.Scope)
+}
+
+// MissingScopes returns any of the given scopes that the tokens were
+// not granted.
+func (a AuthTokens) MissingScopes(scopes ...string) []string {
+	granted := map[string]bool{}
+	for _, scope := range a.Scopes() {
+		granted[scope] = true
+	}
+
+	missing := []string{}
+	for _, scope := range scopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return mergeScopes(missing)
+}
+
+// HasScopes checks whether the tokens were granted all of the given
+// scopes.
+func (a AuthTokens) HasScopes(scopes ...string) bool {
+	return len(a.MissingScopes(scopes...)) == 0
+}
+
+// MissingScopeError is returned when an API call is attempted with
+// tokens that weren't granted the scopes it needs.
+type MissingScopeError struct {
+	Scopes []string
+}
+
+func (e MissingScopeError) Error() string {
+	return "Missing OAuth scopes: " + strings.Join(e.Scopes, ", ")
+}
+
+// requireScopes returns a MissingScopeError if the tokens lack any of
+// the given scopes.
+func requireScopes(authTokens AuthTokens, scopes ...string) error {
+	missing := authTokens.MissingScopes(scopes...)
+	if len(missing) != 0 {
+		return MissingScopeError{Scopes: missing}
+	}
+	return nil
+}
+
+// requirePlaylistScope checks that the tokens can perform an operation
+// on a playlist which needs publicScope if the playlist is public and
+// privateScope otherwise.  An empty publicScope means public playlists
+// need no scope at all.  Collaborative playlists are never public, so
+// they always need privateScope.  The playlist is only fetched if the
+// tokens are missing one of the scopes.
+func requirePlaylistScope(
+	ctx context.Context,
+	authTokens AuthTokens,
+	playlistID string,
+	publicScope string,
+	privateScope string,
+) error {
+	scopes := []string{privateScope}
+	if publicScope != "" {
+		scopes = append(scopes, publicScope)
+	}
+	if authTokens.HasScopes(scopes...) {
+		return nil
+	}
+
+	playlist, err := GetPlaylist(ctx, authTokens, playlistID)
+	if err != nil {
+		return err
+	}
+
+	if playlist.Public && !playlist.Collaborative {
+		if publicScope == "" {
+			return nil
+		}
+		return requireScopes(authTokens, publicScope)
+	}
+	return requireScopes(authTokens, privateScope)
+}
+
+// mergeScopes sorts a list of scopes and removes any duplicates.
+func mergeScopes(scopes []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, scope := range scopes {
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		merged = append(merged, scope)
+	}
+	sort.Strings(merged)
+	return merged
+}
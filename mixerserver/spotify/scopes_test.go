@@ -0,0 +1,141 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLegacyTokensGetLegacyScopes(t *testing.T) {
+	authTokens := AuthTokens{AccessToken: "token"}
+	if missing := authTokens.MissingScopes(legacyScopes...); len(missing) != 0 {
+		t.Errorf("legacy tokens are missing %v", missing)
+	}
+	if authTokens.HasScopes(ScopeUserTopRead) {
+		t.Error("legacy tokens have a scope they were never granted")
+	}
+}
+
+func TestRequirePlaylistScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		scope         string
+		public        bool
+		collaborative bool
+		publicScope   string
+		privateScope  string
+		missing       []string
+	}{
+		{
+			name:         "read public without scopes",
+			scope:        ScopeUserTopRead,
+			public:       true,
+			privateScope: ScopePlaylistReadPrivate,
+		},
+		{
+			name:         "read private without scopes",
+			scope:        ScopeUserTopRead,
+			privateScope: ScopePlaylistReadPrivate,
+			missing:      []string{ScopePlaylistReadPrivate},
+		},
+		{
+			name:          "read collaborative without scopes",
+			scope:         ScopeUserTopRead,
+			public:        true,
+			collaborative: true,
+			privateScope:  ScopePlaylistReadPrivate,
+			missing:       []string{ScopePlaylistReadPrivate},
+		},
+		{
+			name:         "write public with public scope",
+			scope:        ScopePlaylistModifyPublic,
+			public:       true,
+			publicScope:  ScopePlaylistModifyPublic,
+			privateScope: ScopePlaylistModifyPrivate,
+		},
+		{
+			name:         "write private with public scope",
+			scope:        ScopePlaylistModifyPublic,
+			publicScope:  ScopePlaylistModifyPublic,
+			privateScope: ScopePlaylistModifyPrivate,
+			missing:      []string{ScopePlaylistModifyPrivate},
+		},
+		{
+			name:         "write public with private scope",
+			scope:        ScopePlaylistModifyPrivate,
+			public:       true,
+			publicScope:  ScopePlaylistModifyPublic,
+			privateScope: ScopePlaylistModifyPrivate,
+			missing:      []string{ScopePlaylistModifyPublic},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(
+					w,
+					`{"id":"list","public":%t,"collaborative":%t}`,
+					test.public,
+					test.collaborative,
+				)
+			})
+
+			err := requirePlaylistScope(
+				context.Background(),
+				AuthTokens{AccessToken: "token", Scope: test.scope},
+				"list",
+				test.publicScope,
+				test.privateScope,
+			)
+
+			var scopeErr MissingScopeError
+			switch {
+			case test.missing == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.missing == nil:
+			case !errors.As(err, &scopeErr):
+				t.Fatalf("expected missing scopes, got %v", err)
+			case fmt.Sprint(scopeErr.Scopes) != fmt.Sprint(test.missing):
+				t.Errorf("missing %v, want %v", scopeErr.Scopes, test.missing)
+			}
+		})
+	}
+}
+
+func TestRequirePlaylistScopeSkipsFetchWhenGranted(t *testing.T) {
+	stubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+	})
+
+	err := requirePlaylistScope(
+		context.Background(),
+		AuthTokens{AccessToken: "token"},
+		"list",
+		ScopePlaylistModifyPublic,
+		ScopePlaylistModifyPrivate,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
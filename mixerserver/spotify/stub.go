@@ -0,0 +1,52 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// handlerTransport sends requests straight to a handler instead of
+// over the network.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, r)
+	return recorder.Result(), nil
+}
+
+// StubAPI sends every request the Spotify client makes to handler
+// instead of over the network, and returns a function that puts the
+// client back the way it was.  It's a hook for tests of code that
+// calls the API, which should call it with t.Cleanup:
+//
+//	t.Cleanup(spotify.StubAPI(handler))
+//
+// Only one stub can be in place at a time, so tests using it can't
+// run in parallel.
+func StubAPI(handler http.Handler) (restore func()) {
+	transport := client.Transport
+	client.Transport = handlerTransport{handler}
+	return func() { client.Transport = transport }
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"strconv"
+)
+
+// Track is a track in a playlist, with the metadata the mixer can
+// filter on.  Duration is in milliseconds, and popularity runs from 0
+// to 100.
+type Track struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Explicit   bool     `json:"explicit"`
+	Popularity int      `json:"popularity"`
+	DurationMS int      `json:"duration_ms"`
+	Artists    []Artist `json:"artists"`
+	Album      Album    `json:"album"`
+}
+
+// Artist identifies one of a track's artists.
+type Artist struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Album identifies the album a track is from.  ReleaseDate is as
+// precise as Spotify knows it, so it may be just a year, a year and
+// month, or a full date.
+type Album struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ReleaseDate string `json:"release_date"`
+}
+
+// trackFields is the fields parameter that fills in a Track.
+const trackFields = "" +
+	"id,name,explicit,popularity,duration_ms," +
+	"artists(id,name),album(id,name,release_date)"
+
+// ReleaseYear returns the year the track's album was released, or
+// zero if Spotify doesn't know.
+func (track Track) ReleaseYear() int {
+	if len(track.Album.ReleaseDate) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(track.Album.ReleaseDate[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
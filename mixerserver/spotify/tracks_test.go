@@ -0,0 +1,46 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spotify
+
+import (
+	"testing"
+)
+
+func TestReleaseYear(t *testing.T) {
+	tests := []struct {
+		date string
+		want int
+	}{
+		{"1999-12-31", 1999},
+		{"1999-12", 1999},
+		{"1999", 1999},
+		{"", 0},
+		{"199", 0},
+		{"0000", 0},
+		{"abcd-01-01", 0},
+	}
+
+	for _, test := range tests {
+		track := Track{Album: Album{ReleaseDate: test.date}}
+		if got := track.ReleaseYear(); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.date, got, test.want)
+		}
+	}
+}
@@ -20,29 +20,35 @@
 package spotify
 
 import (
+	"context"
 	"encoding/json"
-	"net/http"
 	"net/url"
 )
 
 // GetUserID fetches the Spotify user ID of the logged-in user.
-func GetUserID(authTokens AuthTokens) (userID string, err error) {
-	client := &http.Client{}
+func GetUserID(
+	ctx context.Context,
+	authTokens AuthTokens,
+) (userID string, err error) {
 	uri, err := url.Parse("https://api.spotify.com/v1/me")
 	if err != nil {
 		return
 	}
 
-	request, err := NewAuthenticatedRequest(authTokens, "GET", uri, nil)
+	request, err := NewAuthenticatedRequest(ctx, authTokens, "GET", uri, nil)
 	if err != nil {
 		return
 	}
 
-	response, err := client.Do(request)
+	response, err := do("me", request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
+	err = checkResponse(response)
+	if err != nil {
+		return
+	}
 
 	output := struct {
 		UserID string `json:"id"`
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package store keeps the server's persistent state, like schedules,
+// in an embedded bbolt database.  Values are stored as JSON, grouped
+// into buckets and keyed by strings.
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+// ErrNotFound is returned when looking up a key that isn't stored.
+var ErrNotFound = errors.New("Not found")
+
+// Store is an open database.
+type Store struct {
+	db *bbolt.DB
+}
+
+// Open opens the database at the given path, creating it if it
+// doesn't exist yet.
+func Open(path string) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put stores value under key in the given bucket, replacing whatever
+// was there.
+func (s *Store) Put(bucket string, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), encoded)
+	})
+}
+
+// Get decodes the value stored under key in the given bucket into
+// value, returning ErrNotFound if there isn't one.
+func (s *Store) Get(bucket string, key string, value interface{}) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		encoded := b.Get([]byte(key))
+		if encoded == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(encoded, value)
+	})
+}
+
+// Update decodes the value stored under key in the given bucket into
+// value, calls modify, and stores value back again, all in a single
+// transaction.  It returns ErrNotFound without calling modify if
+// there's no value under key, and stores nothing if modify returns an
+// error.
+func (s *Store) Update(
+	bucket string,
+	key string,
+	value interface{},
+	modify func() error,
+) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		encoded := b.Get([]byte(key))
+		if encoded == nil {
+			return ErrNotFound
+		}
+		err := json.Unmarshal(encoded, value)
+		if err != nil {
+			return err
+		}
+
+		err = modify()
+		if err != nil {
+			return err
+		}
+
+		encoded, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), encoded)
+	})
+}
+
+// Delete removes key from the given bucket.  Deleting a key that
+// isn't there is not an error.
+func (s *Store) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteIf removes every key in the given bucket that starts with
+// prefix and for which match returns true, all in a single
+// transaction.  match gets each key along with its encoded value.
+func (s *Store) DeleteIf(
+	bucket string,
+	prefix string,
+	match func(key string, value []byte) bool,
+) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		// Deleting under a cursor skips the key after the deleted
+		// one, so gather the keys first.
+		keys := [][]byte{}
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if match(string(k), v) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+		}
+		for _, k := range keys {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePrefix removes every key in the given bucket that starts
+// with prefix, all in a single transaction.
+func (s *Store) DeletePrefix(bucket string, prefix string) error {
+	return s.DeleteIf(
+		bucket,
+		prefix,
+		func(key string, value []byte) bool { return true },
+	)
+}
+
+// Prune removes all but the last keep keys in the given bucket that
+// start with prefix, all in a single transaction.  Since IDs from
+// NextID sort in the order they were handed out, this keeps the most
+// recent entries.
+func (s *Store) Prune(bucket string, prefix string, keep int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return prune(b, prefix, keep)
+	})
+}
+
+// PutPruned stores value under key like Put, then removes all but
+// the last keep keys starting with prefix like Prune, all in a single
+// transaction.  It's for appending to a log that's capped in length.
+func (s *Store) PutPruned(
+	bucket string,
+	key string,
+	value interface{},
+	prefix string,
+	keep int,
+) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(key), encoded)
+		if err != nil {
+			return err
+		}
+		return prune(b, prefix, keep)
+	})
+}
+
+// prune removes all but the last keep keys in b that start with
+// prefix.
+func prune(b *bbolt.Bucket, prefix string, keep int) error {
+	keys := [][]byte{}
+	c := b.Cursor()
+	p := []byte(prefix)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for len(keys) > keep {
+		err := b.Delete(keys[0])
+		if err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// ForEach calls fn with every key in the given bucket that starts
+// with prefix, in key order, along with its encoded value.  The value
+// is only valid until fn returns, and should be decoded with
+// json.Unmarshal.  If fn returns an error iteration stops, and
+// ForEach returns that error.
+func (s *Store) ForEach(
+	bucket string,
+	prefix string,
+	fn func(key string, value []byte) error,
+) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			err := fn(string(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachReverse is like ForEach, but goes in reverse key order,
+// starting from the last key before the given one.  If before is
+// empty, it starts from the last key with the prefix.
+func (s *Store) ForEachReverse(
+	bucket string,
+	prefix string,
+	before string,
+	fn func(key string, value []byte) error,
+) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		// Keys are plain text, so nothing with the prefix sorts
+		// after the prefix followed by 0xff.
+		start := []byte(prefix + "\xff")
+		if before != "" {
+			start = []byte(before)
+		}
+
+		c := b.Cursor()
+		p := []byte(prefix)
+		k, v := c.Seek(start)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, p); k, v = c.Prev() {
+			err := fn(string(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NextID returns a new unique ID for the given bucket.  IDs are
+// zero-padded so they sort in the order they were handed out.
+func (s *Store) NextID(bucket string) (string, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		id, err = b.NextSequence()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%012d", id), nil
+}
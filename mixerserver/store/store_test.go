@@ -0,0 +1,139 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	st, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func keys(t *testing.T, st *Store, bucket string) []string {
+	t.Helper()
+	found := []string{}
+	err := st.ForEach(bucket, "", func(key string, value []byte) error {
+		found = append(found, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestPrune(t *testing.T) {
+	cases := []struct {
+		name string
+		keep int
+		want []string
+	}{
+		{"keeps newest", 2, []string{"a/3", "a/4", "b/0", "b/1"}},
+		{"under limit", 10, []string{
+			"a/0", "a/1", "a/2", "a/3", "a/4", "b/0", "b/1",
+		}},
+		{"keep none", 0, []string{"b/0", "b/1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			st := openTestStore(t)
+			for i := 0; i < 5; i++ {
+				err := st.Put("test", fmt.Sprintf("a/%d", i), i)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				err := st.Put("test", fmt.Sprintf("b/%d", i), i)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := st.Prune("test", "a/", c.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := keys(t, st, "test")
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got keys %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	st := openTestStore(t)
+	for _, key := range []string{"a", "a/1", "a/2", "ab/1", "b/1"} {
+		err := st.Put("test", key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := st.DeletePrefix("test", "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := keys(t, st, "test")
+	want := []string{"a", "ab/1", "b/1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	st := openTestStore(t)
+	err := st.Prune("missing", "a/", 1)
+	if err != nil {
+		t.Errorf("Prune on a missing bucket: %v", err)
+	}
+	err = st.DeletePrefix("missing", "a/")
+	if err != nil {
+		t.Errorf("DeletePrefix on a missing bucket: %v", err)
+	}
+}
+
+func TestPutPruned(t *testing.T) {
+	st := openTestStore(t)
+	for i := 0; i < 5; i++ {
+		err := st.PutPruned("test", fmt.Sprintf("a/%d", i), i, "a/", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := keys(t, st, "test")
+	want := []string{"a/2", "a/3", "a/4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+}
@@ -48,5 +48,12 @@ func initTemplates(
 		return err
 	}
 
+	globalContext.Templates.Error, err = template.ParseFiles(
+		staticPath("error.got"),
+	)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
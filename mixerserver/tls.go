@@ -0,0 +1,152 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/bieber/mixer/mixerserver/certs"
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/bieber/mixer/mixerserver/handlers"
+	"github.com/bieber/mixer/mixerserver/middleware"
+	"github.com/justinas/alice"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// initTLS sets up native TLS if the config asks for it, either with a
+// certificate and key from disk (reloaded whenever they change) or
+// with certificates fetched automatically over ACME.  It returns a nil
+// config if TLS is disabled.  Otherwise, plainHandler should serve
+// the plain HTTP port: it redirects everything to HTTPS, apart from
+// ACME challenges in autocert mode.  If closer isn't nil, it should be
+// closed once the servers have stopped.
+func initTLS(globalContext *context.GlobalContext) (
+	tlsConfig *tls.Config,
+	plainHandler http.Handler,
+	closer io.Closer,
+	err error,
+) {
+	certFile := viper.GetString("tls_cert_file")
+	keyFile := viper.GetString("tls_key_file")
+	autocertHosts := viper.GetStringSlice("tls_autocert_hosts")
+
+	redirect := plainRedirect(globalContext)
+
+	switch {
+	case certFile != "" && len(autocertHosts) != 0:
+		return nil, nil, nil, errors.New(
+			"tls_cert_file and tls_autocert_hosts can't both be set",
+		)
+
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, nil, nil, errors.New(
+				"tls_cert_file and tls_key_file must be set together",
+			)
+		}
+
+		reloader, err := certs.NewReloader(
+			certFile,
+			keyFile,
+			globalContext.Logger,
+		)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		return tlsConfig, redirect, reloader, nil
+
+	case len(autocertHosts) != 0:
+		cacheDir := viper.GetString("tls_autocert_cache_dir")
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(autocertHosts...),
+			Email:      viper.GetString("tls_autocert_email"),
+		}
+		tlsConfig = manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, manager.HTTPHandler(redirect), nil, nil
+	}
+
+	return nil, nil, nil, nil
+}
+
+// plainRedirect returns the handler that redirects plain HTTP
+// requests to HTTPS, behind the same host check as the main router.
+func plainRedirect(globalContext *context.GlobalContext) http.Handler {
+	return alice.New(
+		middleware.ErrorCatcher(globalContext, handlers.PlainErrors),
+		middleware.HostChecker(globalContext),
+	).Then(httpsRedirect(globalContext, viper.GetInt("tls_port")))
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over
+// HTTPS.  The redirect goes to public_url's host if that's set.
+// Otherwise it goes to the requested host, which must already have
+// been checked against the allowed hosts, so the Host header can't be
+// used to redirect anywhere else.  With no hosts configured at all
+// there's nowhere safe to redirect to, so every request is refused.
+func httpsRedirect(
+	globalContext *context.GlobalContext,
+	tlsPort int,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		publicURL := globalContext.PublicURL
+		if publicURL != nil && publicURL.Scheme == "https" {
+			target := "https://" + publicURL.Host + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		var hostname string
+		switch {
+		case publicURL != nil:
+			hostname = publicURL.Hostname()
+		case len(globalContext.AllowedHosts) != 0:
+			hostname = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				hostname = h
+			}
+			hostname = strings.Trim(hostname, "[]")
+		default:
+			panic(handlers.BadRequest("No host to redirect to", nil))
+		}
+
+		host := hostname
+		if tlsPort != 443 {
+			host = net.JoinHostPort(hostname, strconv.Itoa(tlsPort))
+		} else if strings.Contains(hostname, ":") {
+			host = "[" + hostname + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
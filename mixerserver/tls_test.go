@@ -0,0 +1,106 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"github.com/bieber/mixer/mixerserver/context"
+	"github.com/spf13/viper"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		allowed   []string
+		tlsPort   int
+		host      string
+		status    int
+		location  string
+	}{
+		{
+			name:      "public URL",
+			publicURL: "https://mixer.example.com/app",
+			allowed:   []string{"mixer.example.com"},
+			tlsPort:   443,
+			host:      "mixer.example.com",
+			status:    http.StatusMovedPermanently,
+			location:  "https://mixer.example.com/app/x?y=1",
+		},
+		{
+			name:     "allowed host on another port",
+			allowed:  []string{"mixer.example.com"},
+			tlsPort:  8443,
+			host:     "mixer.example.com:8080",
+			status:   http.StatusMovedPermanently,
+			location: "https://mixer.example.com:8443/app/x?y=1",
+		},
+		{
+			name:    "spoofed host",
+			allowed: []string{"mixer.example.com"},
+			tlsPort: 443,
+			host:    "evil.example.com",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "no hosts configured",
+			tlsPort: 443,
+			host:    "evil.example.com",
+			status:  http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			globalContext := &context.GlobalContext{
+				Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+				AllowedHosts: test.allowed,
+			}
+			if test.publicURL != "" {
+				publicURL, err := url.Parse(test.publicURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				globalContext.PublicURL = publicURL
+			}
+			viper.Set("tls_port", test.tlsPort)
+			defer viper.Reset()
+
+			handler := plainRedirect(globalContext)
+
+			request := httptest.NewRequest("GET", "/app/x?y=1", nil)
+			request.Host = test.host
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			location := recorder.Header().Get("Location")
+			if location != test.location {
+				t.Errorf("redirected to %q, want %q", location, test.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/metrics"
+	"github.com/bieber/mixer/mixerserver/store"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxAttempts is the number of times a delivery is tried before it's
+// given up on.
+const maxAttempts = 5
+
+// retryDelay is how long to wait before the first retry of a failed
+// delivery.  Each retry after that waits twice as long as the last.
+// It's a variable so tests can shorten it.
+var retryDelay = 10 * time.Second
+
+// requestTimeout caps how long a webhook has to respond.
+const requestTimeout = 10 * time.Second
+
+// errPrivateAddress is returned when a user's webhook resolves to an
+// address on the server's own network.
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// Event is the payload sent to webhooks when a mix finishes.  Tracks is
+// the number of tracks written, Excluded and Filtered the number of
+// source tracks left out because of exclusion playlists and filters,
+// and Duration is in seconds.
+type Event struct {
+	Event          string    `json:"event"`
+	HistoryID      string    `json:"history_id,omitempty"`
+	JobID          string    `json:"job_id"`
+	UserID         string    `json:"user_id"`
+	Trigger        string    `json:"trigger"`
+	ScheduleID     string    `json:"schedule_id,omitempty"`
+	Sources        []string  `json:"sources"`
+	Destination    string    `json:"destination"`
+	DestinationURL string    `json:"destination_url"`
+	Tracks         int       `json:"tracks"`
+	Excluded       int       `json:"excluded"`
+	Filtered       int       `json:"filtered"`
+	Seed           int64     `json:"seed"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	Duration       float64   `json:"duration"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Config holds the server-wide webhook settings.  URLs are global
+// webhooks, notified of Events for every user's mixes and signed with
+// Secret.  AllowPrivate lets users' webhooks reach loopback and
+// private network addresses, which they otherwise can't, so they
+// can't be used to probe the network the server runs on.
+type Config struct {
+	URLs         []string
+	Secret       string
+	Events       []string
+	AllowPrivate bool
+}
+
+// Dispatcher delivers events to webhooks in the background.
+type Dispatcher struct {
+	store      *store.Store
+	logger     *slog.Logger
+	global     []Hook
+	secret     string
+	client     *http.Client
+	userClient *http.Client
+
+	ctx    gocontext.Context
+	cancel gocontext.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher that reads users' webhooks from
+// and logs deliveries to st.
+func NewDispatcher(
+	st *store.Store,
+	logger *slog.Logger,
+	config Config,
+) *Dispatcher {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	d := &Dispatcher{
+		store:  st,
+		logger: logger,
+		secret: config.Secret,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for i, hookURL := range config.URLs {
+		d.global = append(d.global, Hook{
+			ID:     "global-" + strconv.Itoa(i),
+			URL:    hookURL,
+			Events: config.Events,
+		})
+	}
+
+	noRedirects := func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	d.client = &http.Client{
+		Timeout:       requestTimeout,
+		CheckRedirect: noRedirects,
+	}
+	d.userClient = d.client
+	if !config.AllowPrivate {
+		dialer := &net.Dialer{Control: publicOnly}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+		d.userClient = &http.Client{
+			Transport:     transport,
+			Timeout:       requestTimeout,
+			CheckRedirect: noRedirects,
+		}
+	}
+	return d
+}
+
+// blockedPrefixes are address ranges that aren't public, beyond the
+// loopback, private and link local ones net/netip already knows.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+}
+
+// publicOnly refuses connections to loopback, private, link local,
+// carrier-grade NAT and NAT64 addresses.  IPv4-mapped IPv6 addresses
+// are judged by the IPv4 address they map to.  It's checked on the
+// address actually dialled, so it can't be sidestepped with DNS.
+func publicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return errPrivateAddress
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// Notify sends event to the global webhooks and the webhooks of the
+// user whose mix it is, if they want it.  Deliveries happen in the
+// background, so Notify doesn't wait for them.
+func (d *Dispatcher) Notify(event Event) {
+	logger := d.logger.With("job_id", event.JobID, "user_id", event.UserID)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("couldn't encode webhook event", "error", err)
+		return
+	}
+
+	for _, hook := range d.global {
+		if hook.Wants(event.Event) {
+			d.start(hook, d.secret, d.client, event, body, logger)
+		}
+	}
+
+	records, err := listRecords(d.store, event.UserID)
+	if err != nil {
+		logger.Error("couldn't list webhooks", "error", err)
+		return
+	}
+	for _, rec := range records {
+		if !rec.Wants(event.Event) {
+			continue
+		}
+		secret, err := crypto.Decrypt(rec.Secret)
+		if err != nil {
+			logger.Error(
+				"couldn't decrypt webhook secret",
+				"webhook_id", rec.ID,
+				"error", err,
+			)
+			continue
+		}
+		d.start(rec.Hook, secret, d.userClient, event, body, logger)
+	}
+}
+
+// start logs a new delivery and makes it in the background.
+func (d *Dispatcher) start(
+	hook Hook,
+	secret string,
+	client *http.Client,
+	event Event,
+	body []byte,
+	logger *slog.Logger,
+) {
+	logger = logger.With("webhook_id", hook.ID)
+
+	id, err := d.store.NextID(deliveriesBucket)
+	if err != nil {
+		logger.Error("couldn't start webhook delivery", "error", err)
+		return
+	}
+	delivery := Delivery{
+		ID:       id,
+		HookID:   hook.ID,
+		Event:    event.Event,
+		JobID:    event.JobID,
+		Created:  time.Now(),
+		Status:   StatusPending,
+		Attempts: []Attempt{},
+	}
+	// Logging the delivery and dropping the oldest past maxDeliveries
+	// happen together, so the log never grows past its cap.
+	err = d.store.PutPruned(
+		deliveriesBucket,
+		deliveryKey(hook.UserID, hook.ID, delivery.ID),
+		delivery,
+		hookKey(hook.UserID, hook.ID)+"/",
+		maxDeliveries,
+	)
+	if err != nil {
+		logger.Error("couldn't log webhook delivery", "error", err)
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(hook, secret, client, delivery, body, logger)
+	}()
+}
+
+// deliver tries to deliver an event to a webhook until it succeeds,
+// fails in a way retrying won't fix, or runs out of attempts.
+func (d *Dispatcher) deliver(
+	hook Hook,
+	secret string,
+	client *http.Client,
+	delivery Delivery,
+	body []byte,
+	logger *slog.Logger,
+) {
+	delay := retryDelay
+	for {
+		attempt, retry := d.send(hook, secret, client, delivery, body)
+		delivery.Attempts = append(delivery.Attempts, attempt)
+
+		switch {
+		case attempt.Error == "":
+			delivery.Status = StatusDelivered
+		case !retry || len(delivery.Attempts) >= maxAttempts:
+			delivery.Status = StatusFailed
+			logger.Warn(
+				"webhook delivery failed",
+				"attempts", len(delivery.Attempts),
+				"error", attempt.Error,
+			)
+		}
+		d.save(hook, delivery, logger)
+		if delivery.Status != StatusPending {
+			metrics.WebhookDeliveries.WithLabelValues(delivery.Status).Inc()
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-d.ctx.Done():
+			delivery.Status = StatusFailed
+			d.save(hook, delivery, logger)
+			metrics.WebhookDeliveries.WithLabelValues(delivery.Status).Inc()
+			logger.Warn("abandoning webhook delivery on shutdown")
+			return
+		}
+	}
+}
+
+// send makes a single attempt at a delivery, and reports whether it's
+// worth trying again if it failed.
+func (d *Dispatcher) send(
+	hook Hook,
+	secret string,
+	client *http.Client,
+	delivery Delivery,
+	body []byte,
+) (attempt Attempt, retry bool) {
+	attempt.Time = time.Now()
+	defer func() {
+		attempt.Duration = time.Since(attempt.Time).Seconds()
+	}()
+
+	request, err := http.NewRequestWithContext(
+		d.ctx,
+		"POST",
+		hook.URL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+
+	timestamp := strconv.FormatInt(attempt.Time.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "mixer-webhook")
+	request.Header.Set("X-Mixer-Event", delivery.Event)
+	request.Header.Set("X-Mixer-Delivery", delivery.ID)
+	request.Header.Set("X-Mixer-Timestamp", timestamp)
+	request.Header.Set("X-Mixer-Signature", Sign(secret, timestamp, body))
+
+	response, err := client.Do(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, !errors.Is(err, errPrivateAddress)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	attempt.StatusCode = response.StatusCode
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return attempt, true
+	}
+	attempt.Error = fmt.Sprintf(
+		"webhook responded %d %s",
+		response.StatusCode,
+		http.StatusText(response.StatusCode),
+	)
+	return attempt, response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode >= 500
+}
+
+// save stores the current state of a delivery.  A delivery that's
+// been pruned from the log while it was being retried stays pruned.
+func (d *Dispatcher) save(
+	hook Hook,
+	delivery Delivery,
+	logger *slog.Logger,
+) {
+	stored := Delivery{}
+	err := d.store.Update(
+		deliveriesBucket,
+		deliveryKey(hook.UserID, hook.ID, delivery.ID),
+		&stored,
+		func() error {
+			stored = delivery
+			return nil
+		},
+	)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		logger.Error("couldn't log webhook delivery", "error", err)
+	}
+}
+
+// Close stops retrying deliveries, waiting until ctx is done for any
+// still in progress to finish first.
+func (d *Dispatcher) Close(ctx gocontext.Context) {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	d.cancel()
+	<-done
+}
+
+// Sign returns the signature for a webhook request with the given
+// timestamp and body, as sent in the X-Mixer-Signature header.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/store"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	got := Sign("secret", "1700000000", []byte(`{"event":"mix.succeeded"}`))
+	want := "sha256=" +
+		"8f960c291aadd2106feaee18cf867b62b9b87ff59c8dcf4b643286452ec4b671"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"100.128.0.1:80", true},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1%eth0]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:10.0.0.1]:80", false},
+		{"[::ffff:93.184.216.34]:443", true},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[64:ff9b::5db8:d822]:443", false},
+		{"[64:ff9b:1::1]:80", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := publicOnly("tcp", test.address, nil)
+			if test.public && err != nil {
+				t.Errorf("got %v, want it allowed", err)
+			} else if !test.public && err != errPrivateAddress {
+				t.Errorf("got %v, want %v", err, errPrivateAddress)
+			}
+		})
+	}
+}
+
+// newTestDispatcher creates a dispatcher logging deliveries to a
+// temporary store, with retries shortened so tests don't wait.
+func newTestDispatcher(t *testing.T, config Config) *Dispatcher {
+	t.Helper()
+	st, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewDispatcher(st, logger, config)
+}
+
+// storedDeliveries returns a webhook's delivery log, oldest first.
+func storedDeliveries(t *testing.T, d *Dispatcher, hook Hook) []Delivery {
+	t.Helper()
+	deliveries := []Delivery{}
+	err := d.store.ForEach(
+		deliveriesBucket,
+		hookKey(hook.UserID, hook.ID)+"/",
+		func(key string, value []byte) error {
+			delivery := Delivery{}
+			err := json.Unmarshal(value, &delivery)
+			deliveries = append(deliveries, delivery)
+			return err
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int
+		status    string
+	}{
+		{"delivered", []int{200}, StatusDelivered},
+		{"retried after server error", []int{500, 502, 204}, StatusDelivered},
+		{"retried after rate limit", []int{429, 200}, StatusDelivered},
+		{"client error not retried", []int{400}, StatusFailed},
+		{"gives up", []int{500, 500, 500, 500, 500}, StatusFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			requests := 0
+			body := []byte(`{"event":"mix.succeeded"}`)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					mutex.Lock()
+					defer mutex.Unlock()
+
+					received, _ := io.ReadAll(r.Body)
+					timestamp := r.Header.Get("X-Mixer-Timestamp")
+					signature := r.Header.Get("X-Mixer-Signature")
+					if signature != Sign("secret", timestamp, received) {
+						t.Errorf("bad signature %s", signature)
+					}
+					if string(received) != string(body) {
+						t.Errorf("got body %s, want %s", received, body)
+					}
+					if r.Header.Get("X-Mixer-Event") != EventSucceeded {
+						t.Errorf(
+							"got event %s",
+							r.Header.Get("X-Mixer-Event"),
+						)
+					}
+
+					w.WriteHeader(test.responses[requests])
+					requests++
+				},
+			))
+			defer server.Close()
+
+			d := newTestDispatcher(t, Config{})
+			hook := Hook{ID: "hook", UserID: "user", URL: server.URL}
+			d.start(
+				hook,
+				"secret",
+				d.client,
+				Event{Event: EventSucceeded, JobID: "job"},
+				body,
+				d.logger,
+			)
+			d.Close(gocontext.Background())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if requests != len(test.responses) {
+				t.Errorf(
+					"got %d requests, want %d",
+					requests,
+					len(test.responses),
+				)
+			}
+			deliveries := storedDeliveries(t, d, hook)
+			if len(deliveries) != 1 {
+				t.Fatalf("got %d deliveries, want 1", len(deliveries))
+			}
+			delivery := deliveries[0]
+			if delivery.Status != test.status {
+				t.Errorf(
+					"got status %s, want %s",
+					delivery.Status,
+					test.status,
+				)
+			}
+			if delivery.JobID != "job" || delivery.HookID != "hook" {
+				t.Errorf("got delivery %+v", delivery)
+			}
+			if len(delivery.Attempts) != len(test.responses) {
+				t.Fatalf(
+					"got %d attempts, want %d",
+					len(delivery.Attempts),
+					len(test.responses),
+				)
+			}
+			for i, attempt := range delivery.Attempts {
+				if attempt.StatusCode != test.responses[i] {
+					t.Errorf(
+						"attempt %d got status %d, want %d",
+						i,
+						attempt.StatusCode,
+						test.responses[i],
+					)
+				}
+				failed := test.responses[i] >= 300
+				if failed != (attempt.Error != "") {
+					t.Errorf("attempt %d got error %q", i, attempt.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliverPrivateAddress(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { requests++ },
+	))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Config{})
+	hook := Hook{ID: "hook", UserID: "user", URL: server.URL}
+	d.start(
+		hook,
+		"secret",
+		d.userClient,
+		Event{Event: EventSucceeded},
+		[]byte("{}"),
+		d.logger,
+	)
+	d.Close(gocontext.Background())
+
+	if requests != 0 {
+		t.Errorf("got %d requests to a private address", requests)
+	}
+	deliveries := storedDeliveries(t, d, hook)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	delivery := deliveries[0]
+	if delivery.Status != StatusFailed || len(delivery.Attempts) != 1 {
+		t.Errorf(
+			"got status %s after %d attempts, want one failed attempt",
+			delivery.Status,
+			len(delivery.Attempts),
+		)
+	}
+	if !strings.Contains(delivery.Attempts[0].Error, "not public") {
+		t.Errorf("got error %q", delivery.Attempts[0].Error)
+	}
+}
+
+func TestDeliveriesPruned(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Config{})
+	hook := Hook{ID: "hook", UserID: "user", URL: server.URL}
+	for i := 0; i < maxDeliveries+5; i++ {
+		d.start(
+			hook,
+			"secret",
+			d.client,
+			Event{Event: EventSucceeded, JobID: fmt.Sprint(i)},
+			[]byte("{}"),
+			d.logger,
+		)
+	}
+	d.Close(gocontext.Background())
+
+	deliveries := storedDeliveries(t, d, hook)
+	if len(deliveries) != maxDeliveries {
+		t.Fatalf(
+			"got %d deliveries, want %d",
+			len(deliveries),
+			maxDeliveries,
+		)
+	}
+	if deliveries[0].JobID != "5" {
+		t.Errorf("oldest kept delivery is %s, want 5", deliveries[0].JobID)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package webhook notifies outside services when mixes finish, by
+// POSTing a JSON summary of the mix to each webhook that wants to hear
+// about it.  Users register their own webhooks, which hear about their
+// own mixes, and the server's config can add global ones that hear
+// about everyone's.
+//
+// Every request is signed so receivers can check it came from us.
+// The X-Mixer-Signature header holds "sha256=" followed by the hex
+// HMAC-SHA256, keyed with the webhook's secret, of the
+// X-Mixer-Timestamp header, a period and the request body.  Failed
+// deliveries are retried with backoff, and every attempt is kept in
+// a delivery log.
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bieber/mixer/mixerserver/crypto"
+	"github.com/bieber/mixer/mixerserver/store"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	hooksBucket      = "webhooks"
+	deliveriesBucket = "webhook_deliveries"
+)
+
+// maxHooks is the number of webhooks each user can register.
+const maxHooks = 10
+
+// maxDeliveries is the number of deliveries kept in each webhook's
+// log.
+const maxDeliveries = 100
+
+// Events a webhook can be notified of.
+const (
+	EventSucceeded = "mix.succeeded"
+	EventFailed    = "mix.failed"
+	EventCancelled = "mix.cancelled"
+)
+
+// Events lists every event, in the order they're documented.
+var Events = []string{EventSucceeded, EventFailed, EventCancelled}
+
+// ErrNotFound is returned when a webhook doesn't exist, or belongs to
+// someone else.
+var ErrNotFound = errors.New("Webhook not found")
+
+// ErrTooMany is returned when a user already has as many webhooks as
+// they're allowed.
+var ErrTooMany = fmt.Errorf("At most %d webhooks are allowed", maxHooks)
+
+// Hook is a URL to notify about finished mixes.  Events lists the
+// events it wants, and all of them if it's empty.  Global webhooks
+// from the config have no user.
+type Hook struct {
+	ID      string    `json:"id"`
+	UserID  string    `json:"user_id,omitempty"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Wants reports whether the webhook should be notified of event.
+func (hook Hook) Wants(event string) bool {
+	return len(hook.Events) == 0 || slices.Contains(hook.Events, event)
+}
+
+// Delivery records the attempts to notify a webhook of one event.
+// Status is pending while there are attempts left to make, and
+// delivered or failed once there aren't.
+type Delivery struct {
+	ID       string    `json:"id"`
+	HookID   string    `json:"hook_id"`
+	Event    string    `json:"event"`
+	JobID    string    `json:"job_id"`
+	Created  time.Time `json:"created"`
+	Status   string    `json:"status"`
+	Attempts []Attempt `json:"attempts"`
+}
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Attempt records a single request to a webhook.  StatusCode is zero
+// if no response came back.  Duration is in seconds.
+type Attempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Duration   float64   `json:"duration"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// record is how a webhook is kept in the store, along with its secret,
+// encrypted with the server's token key.
+type record struct {
+	Hook
+	Secret string `json:"secret"`
+}
+
+// hookKey is the key a webhook is stored under.  Global webhooks have
+// no user, so their keys start with a bare slash, which can't clash
+// with any user's.
+func hookKey(userID string, id string) string {
+	return userID + "/" + id
+}
+
+// deliveryKey is the key a delivery is stored under, sorting in the
+// order the deliveries were made.
+func deliveryKey(userID string, hookID string, id string) string {
+	return hookKey(userID, hookID) + "/" + id
+}
+
+// ValidateURL checks that a webhook URL is an absolute HTTP or HTTPS
+// URL.
+func ValidateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("must be an http or https URL")
+	}
+	if parsed.Host == "" {
+		return errors.New("must include a host")
+	}
+	return nil
+}
+
+// ValidateEvents checks that every event in events is one of Events.
+func ValidateEvents(events []string) error {
+	for _, event := range events {
+		if !slices.Contains(Events, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// Create registers a new webhook for the given user, returning it
+// along with the secret its requests will be signed with.  That's the
+// only time the secret is available.  The URL and events should
+// already be validated.
+func Create(
+	st *store.Store,
+	userID string,
+	hookURL string,
+	events []string,
+) (Hook, string, error) {
+	hooks, err := List(st, userID)
+	if err != nil {
+		return Hook{}, "", err
+	}
+	if len(hooks) >= maxHooks {
+		return Hook{}, "", ErrTooMany
+	}
+
+	secret, err := crypto.GenerateNonce()
+	if err != nil {
+		return Hook{}, "", err
+	}
+	encryptedSecret, err := crypto.Encrypt(secret)
+	if err != nil {
+		return Hook{}, "", err
+	}
+
+	id, err := st.NextID(hooksBucket)
+	if err != nil {
+		return Hook{}, "", err
+	}
+
+	rec := record{
+		Hook: Hook{
+			ID:      id,
+			UserID:  userID,
+			URL:     hookURL,
+			Events:  events,
+			Created: time.Now(),
+		},
+		Secret: encryptedSecret,
+	}
+	err = st.Put(hooksBucket, hookKey(userID, id), rec)
+	if err != nil {
+		return Hook{}, "", err
+	}
+	return rec.Hook, secret, nil
+}
+
+// List returns all of a user's webhooks.
+func List(st *store.Store, userID string) ([]Hook, error) {
+	hooks := []Hook{}
+	records, err := listRecords(st, userID)
+	for _, rec := range records {
+		hooks = append(hooks, rec.Hook)
+	}
+	return hooks, err
+}
+
+func listRecords(st *store.Store, userID string) ([]record, error) {
+	records := []record{}
+	err := st.ForEach(
+		hooksBucket,
+		userID+"/",
+		func(key string, value []byte) error {
+			rec := record{}
+			err := json.Unmarshal(value, &rec)
+			if err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		},
+	)
+	return records, err
+}
+
+// Delete removes one of a user's webhooks, along with its delivery
+// log.
+func Delete(st *store.Store, userID string, id string) error {
+	err := st.Get(hooksBucket, hookKey(userID, id), &record{})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	err = st.Delete(hooksBucket, hookKey(userID, id))
+	if err != nil {
+		return err
+	}
+
+	return st.DeletePrefix(deliveriesBucket, hookKey(userID, id)+"/")
+}
+
+// Deliveries returns the delivery log of one of a user's webhooks,
+// most recent first.
+func Deliveries(
+	st *store.Store,
+	userID string,
+	id string,
+) ([]Delivery, error) {
+	err := st.Get(hooksBucket, hookKey(userID, id), &record{})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	deliveries := []Delivery{}
+	err = st.ForEachReverse(
+		deliveriesBucket,
+		hookKey(userID, id)+"/",
+		"",
+		func(key string, value []byte) error {
+			delivery := Delivery{}
+			err := json.Unmarshal(value, &delivery)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		},
+	)
+	return deliveries, err
+}
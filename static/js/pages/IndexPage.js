@@ -23,6 +23,7 @@ import Qajax from 'qajax';
 import Intro from '../views/Intro.js';
 import Composer from '../views/Composer.js';
 import Submitted from '../views/Submitted.js';
+import ConsentRequired from '../views/ConsentRequired.js';
 
 export default class IndexPage extends React.Component {
 	constructor(props, context) {
@@ -31,13 +32,23 @@ export default class IndexPage extends React.Component {
 			token: null,
 			playlists: null,
 			userID: null,
+			consentURI: null,
 		};
+		this.refreshTimer = null;
+	}
+
+	scheduleRefresh(expiresIn) {
+		clearTimeout(this.refreshTimer);
+		this.refreshTimer = setTimeout(
+			this.refreshToken.bind(this),
+			expiresIn * 1000
+		);
 	}
 
 	onLogin(data) {
-		setTimeout(this.refreshToken.bind(this), data.expires_in * 1000);
+		this.scheduleRefresh(data.expires_in);
 		this.setState(
-			{token: data.token},
+			{token: data.token, consentURI: null},
 			() => Qajax({
 				url: this.props.playlistsURI,
 				params: {token: this.state.token},
@@ -45,9 +56,25 @@ export default class IndexPage extends React.Component {
 				.then(Qajax.filterSuccess)
 				.then(Qajax.toJSON)
 				.then(payload => this.setState(payload))
+				.fail(this.onError.bind(this))
 		)
 	}
 
+	// onError checks whether a failed request needs the user to grant
+	// more permissions, and if so asks them to.
+	onError(xhr) {
+		var payload = {};
+		try {
+			payload = JSON.parse(xhr.responseText);
+		} catch (e) {
+			return;
+		}
+
+		if (payload.code === 'consent_required') {
+			this.setState({submitted: false, consentURI: payload.login_uri});
+		}
+	}
+
 	onSubmit(data) {
 		this.setState(
 			{submitted: true},
@@ -57,14 +84,36 @@ export default class IndexPage extends React.Component {
 				params: {token: this.state.token},
 				data: data,
 			})
+				.then(Qajax.filterSuccess)
+				.fail(this.onError.bind(this))
 		);
 	}
 
 	onRefreshResponse(data) {
-		setTimeout(this.refreshToken.bind(this), data.expires_in * 1000);
+		this.scheduleRefresh(data.expires_in);
 		this.setState({token: data.token});
 	}
 
+	onLogout(event) {
+		event.preventDefault();
+		Qajax({
+			url: this.props.logoutURI,
+			method: 'POST',
+			params: {token: this.state.token},
+		})
+			.then(Qajax.filterSuccess)
+			.then(() => {
+				clearTimeout(this.refreshTimer);
+				this.setState({
+					token: null,
+					playlists: null,
+					userID: null,
+					submitted: false,
+					consentURI: null,
+				});
+			});
+	}
+
 	refreshToken() {
 		Qajax({url: this.props.refreshURI, params: {token: this.state.token}})
 			.then(Qajax.filterSuccess)
@@ -76,6 +125,7 @@ export default class IndexPage extends React.Component {
 		var view = (
 			<Intro
 				loginURI={this.props.loginURI}
+				staticURI={this.props.staticURI}
 				onLogin={this.onLogin.bind(this)}
 			/>
 		);
@@ -93,8 +143,29 @@ export default class IndexPage extends React.Component {
 			view = <Submitted />;
 		}
 
+		if (this.state.consentURI !== null) {
+			view = (
+				<ConsentRequired
+					loginURI={this.state.consentURI}
+					onLogin={this.onLogin.bind(this)}
+				/>
+			);
+		}
+
+		var logout = null;
+		if (this.state.token !== null) {
+			logout = (
+				<p className="logout">
+					<a href="#" onClick={this.onLogout.bind(this)}>
+						Log out
+					</a>
+				</p>
+			);
+		}
+
 		return (
 			<div className="container">
+				{logout}
 				{view}
 			</div>
 		);
@@ -105,4 +176,6 @@ IndexPage.propTypes = {
 	refreshURI: React.PropTypes.string.isRequired,
 	playlistsURI: React.PropTypes.string.isRequired,
 	submitURI: React.PropTypes.string.isRequired,
+	logoutURI: React.PropTypes.string.isRequired,
+	staticURI: React.PropTypes.string.isRequired,
 };
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+var popup = null;
+
+// openLoginPopup opens the Spotify login flow in a popup window.  The
+// login page calls window.opener.onLogin once the user has logged in,
+// so onLogin is installed there first.  Only one popup can be open at
+// a time.
+export default function openLoginPopup(loginURI, onLogin) {
+	if (popup !== null && !popup.closed) {
+		alert('You already have a login popup open');
+		return;
+	}
+
+	var width = 400;
+	var height = 600;
+
+	var windowFeatures = {
+		menubar: 'no',
+		location: 'no',
+		left: (window.screen.width - width) / 2,
+		top: (window.screen.height - height) / 2,
+		width: width,
+		height: height,
+	};
+
+	var featureStrings = [];
+	for (var i in windowFeatures) {
+		featureStrings.push(i+'='+windowFeatures[i]);
+	}
+
+	window.onLogin = onLogin;
+	popup = window.open(loginURI, 'login_window', featureStrings.join(','));
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2015, Robert Bieber
+ *
+ * This file is part of mixer.
+ *
+ * mixer is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mixer is distributed in the hope that it will be useful,
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mixer.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import React from 'react';
+
+import openLoginPopup from '../util/openLoginPopup.js';
+
+export default class ConsentRequired extends React.Component {
+	onGrantClick(event) {
+		event.preventDefault();
+		openLoginPopup(this.props.loginURI, this.props.onLogin);
+	}
+
+	render() {
+		return (
+			<div>
+				<h1>More Permissions Needed</h1>
+				<p>
+					Spotify needs you to give the mixer some additional
+					permissions before it can do that.  Once you've granted
+					them, try again.
+				</p>
+				<p>
+					<a href="#" onClick={this.onGrantClick.bind(this)}>
+						Grant permissions
+					</a>
+				</p>
+			</div>
+		);
+	}
+}
+ConsentRequired.propTypes = {
+	loginURI: React.PropTypes.string.isRequired,
+	onLogin: React.PropTypes.func.isRequired,
+};
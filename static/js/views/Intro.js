@@ -19,42 +19,12 @@
 
 import React from 'react';
 
-export default class Intro extends React.Component {
-	constructor(props, context) {
-		super(props, context);
-		this.popup = null;
-	}
+import openLoginPopup from '../util/openLoginPopup.js';
 
+export default class Intro extends React.Component {
 	onLoginClick(event) {
 		event.preventDefault();
-		if (this.popup !== null && !this.popup.closed) {
-			alert('You already have a login popup open');
-			return;
-		}
-
-		var width = 400;
-		var height = 600;
-
-		var windowFeatures = {
-			menubar: 'no',
-			location: 'no',
-			left: (window.screen.width - width) / 2,
-			top: (window.screen.height - height) / 2,
-			width: width,
-			height: height,
-		};
-
-		var featureStrings = [];
-		for (var i in windowFeatures) {
-			featureStrings.push(i+'='+windowFeatures[i]);
-		}
-
-		window.onLogin = this.props.onLogin;
-		this.popup = window.open(
-			this.props.loginURI,
-			'login_window',
-			featureStrings.join(',')
-		);
+		openLoginPopup(this.props.loginURI, this.props.onLogin);
 	}
 
 	render() {
@@ -105,7 +75,7 @@ export default class Intro extends React.Component {
 					<a
 						href="#"
 						onClick={this.onLoginClick.bind(this)}>
-						<img src="/static/img/login_button.png" />
+						<img src={this.props.staticURI + '/img/login_button.png'} />
 					</a>
 				</div>
 			</div>
@@ -114,5 +84,6 @@ export default class Intro extends React.Component {
 }
 Intro.propTypes = {
 	loginURI: React.PropTypes.string.isRequired,
+	staticURI: React.PropTypes.string.isRequired,
 	onLogin: React.PropTypes.func.isRequired,
 };